@@ -0,0 +1,420 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+const (
+	entriesFile = "entries.jsonl"
+	indexFile   = "index.json"
+
+	// snapshotEvery is how many appends go by between index snapshots, the
+	// entries after the last snapshot are indexed again on Open
+	snapshotEvery = 500
+)
+
+// Archive is an append-only log of room entries with an inverted index.
+// The log is the source of truth, the index is a snapshot that Open
+// catches up with the log.
+type Archive struct {
+	dir string
+	// readOnly archives never touch the files, see OpenReadOnly
+	readOnly bool
+
+	mu      sync.Mutex
+	log     *os.File
+	offsets []int64
+	size    int64
+	// postings maps a term to the IDs of the entries that contain it, in order
+	postings map[string][]int64
+	unsaved  int
+}
+
+// indexSnapshot is the on-disk form of the index, Indexed is how many
+// entries it covers
+type indexSnapshot struct {
+	Indexed  int64              `json:"indexed"`
+	Postings map[string][]int64 `json:"postings"`
+}
+
+// Open opens the archive in dir for writing, creating it when missing.
+// Only one process may have an archive open for writing.
+func Open(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create archive directory: %w", err)
+	}
+	log, err := os.OpenFile(filepath.Join(dir, entriesFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open archive: %w", err)
+	}
+	return open(&Archive{dir: dir, log: log, postings: map[string][]int64{}})
+}
+
+// OpenReadOnly opens the archive in dir for searching and exporting while
+// another process may be appending to it. It sees the entries complete when
+// it was opened, never changes the log and never saves the index.
+func OpenReadOnly(dir string) (*Archive, error) {
+	log, err := os.Open(filepath.Join(dir, entriesFile))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open archive: %w", err)
+	}
+	return open(&Archive{dir: dir, readOnly: true, log: log, postings: map[string][]int64{}})
+}
+
+func open(a *Archive) (*Archive, error) {
+	// the snapshot is read before the log so a writer saving a newer one in
+	// between can't leave it ahead of what was scanned
+	snapshot, err := a.readIndex()
+	if err == nil {
+		err = a.scan()
+	}
+	if err == nil {
+		err = a.loadIndex(snapshot)
+	}
+	if err != nil {
+		a.log.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// scan finds where every entry starts. A line cut short by a crash is
+// dropped, read-only archives leave it be as it may still be being written.
+func (a *Archive) scan() error {
+	reader := bufio.NewReader(a.log)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && !a.readOnly {
+				if err := a.log.Truncate(offset); err != nil {
+					return fmt.Errorf("unable to drop partial archive entry: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read archive: %w", err)
+		}
+		a.offsets = append(a.offsets, offset)
+		offset += int64(len(line))
+	}
+	a.size = offset
+	return nil
+}
+
+func (a *Archive) readIndex() (indexSnapshot, error) {
+	content, err := ioutil.ReadFile(filepath.Join(a.dir, indexFile))
+	var snapshot indexSnapshot
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return snapshot, fmt.Errorf("unable to read archive index: %w", err)
+	default:
+		if err := json.Unmarshal(content, &snapshot); err != nil {
+			return snapshot, fmt.Errorf("unable to parse archive index: %w", err)
+		}
+	}
+	return snapshot, nil
+}
+
+func (a *Archive) loadIndex(snapshot indexSnapshot) error {
+	// a snapshot ahead of the log means the log lost entries, start over
+	if snapshot.Indexed > int64(len(a.offsets)) || snapshot.Postings == nil {
+		snapshot = indexSnapshot{Postings: map[string][]int64{}}
+	}
+	a.postings = snapshot.Postings
+
+	for id := snapshot.Indexed; id < int64(len(a.offsets)); id++ {
+		e, err := a.read(id)
+		if err != nil {
+			return err
+		}
+		a.index(e)
+		a.unsaved++
+	}
+	return nil
+}
+
+func (a *Archive) index(e Entry) {
+	for _, term := range e.indexTerms() {
+		a.postings[term] = append(a.postings[term], e.ID)
+	}
+}
+
+// read must be called with mu held
+func (a *Archive) read(id int64) (Entry, error) {
+	end := a.size
+	if id+1 < int64(len(a.offsets)) {
+		end = a.offsets[id+1]
+	}
+	buf := make([]byte, end-a.offsets[id])
+	if _, err := a.log.ReadAt(buf, a.offsets[id]); err != nil {
+		return Entry{}, fmt.Errorf("unable to read archive entry %d: %w", id, err)
+	}
+	var e Entry
+	if err := json.Unmarshal(bytes.TrimSpace(buf), &e); err != nil {
+		return Entry{}, fmt.Errorf("unable to decode archive entry %d: %w", id, err)
+	}
+	return e, nil
+}
+
+// Add archives a parsed line received at t, lines EntryFor skips are ignored
+func (a *Archive) Add(t time.Time, msg parser.RoomMsg) error {
+	e, ok := EntryFor(t, msg)
+	if !ok {
+		return nil
+	}
+	_, err := a.Append(e)
+	return err
+}
+
+// ErrReadOnly is returned when appending to an archive opened with OpenReadOnly
+var ErrReadOnly = errors.New("archive is open read-only")
+
+// Append writes e to the archive and returns it with its ID set
+func (a *Archive) Append(e Entry) (Entry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.readOnly {
+		return Entry{}, ErrReadOnly
+	}
+
+	e.ID = int64(len(a.offsets))
+	line, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, fmt.Errorf("unable to encode archive entry: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := a.log.Write(line); err != nil {
+		return Entry{}, fmt.Errorf("unable to write archive entry: %w", err)
+	}
+	a.offsets = append(a.offsets, a.size)
+	a.size += int64(len(line))
+	a.index(e)
+
+	a.unsaved++
+	if a.unsaved >= snapshotEvery {
+		if err := a.saveIndex(); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// saveIndex must be called with mu held
+func (a *Archive) saveIndex() error {
+	content, err := json.Marshal(indexSnapshot{Indexed: int64(len(a.offsets)), Postings: a.postings})
+	if err != nil {
+		return fmt.Errorf("unable to encode archive index: %w", err)
+	}
+	tmp, err := ioutil.TempFile(a.dir, indexFile+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create archive index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write archive index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close archive index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(a.dir, indexFile)); err != nil {
+		return fmt.Errorf("unable to replace archive index: %w", err)
+	}
+	a.unsaved = 0
+	return nil
+}
+
+// Len is how many entries the archive holds
+func (a *Archive) Len() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int64(len(a.offsets))
+}
+
+// Entries calls fn for every entry in order between from and to, a zero
+// time leaves that end open. Returning an error from fn stops the walk.
+func (a *Archive) Entries(from, to time.Time, fn func(Entry) error) error {
+	a.mu.Lock()
+	count := int64(len(a.offsets))
+	// entries are appended as they arrive so their times only go up
+	var readErr error
+	start := int64(sort.Search(int(count), func(i int) bool {
+		if from.IsZero() || readErr != nil {
+			return true
+		}
+		e, err := a.read(int64(i))
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return !e.Time.Before(from)
+	}))
+	a.mu.Unlock()
+	if readErr != nil {
+		return readErr
+	}
+
+	for id := start; id < count; id++ {
+		a.mu.Lock()
+		e, err := a.read(id)
+		a.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if !from.IsZero() && e.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !e.Time.Before(to) {
+			break
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close saves the index, unless read-only, and closes the archive
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var err error
+	if a.unsaved > 0 && !a.readOnly {
+		err = a.saveIndex()
+	}
+	if closeErr := a.log.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Query is a search, every term has to appear in a matching entry
+type Query struct {
+	Terms []string
+	// Context is how many entries around each match are returned with it
+	Context int
+	// Limit caps the number of matches, newest first, zero means 10
+	Limit int
+	// Kinds limits matches and context to these kinds, empty means all
+	Kinds []Kind
+}
+
+// Result is a matching entry with the entries around it, oldest first
+type Result struct {
+	Before []Entry
+	Match  Entry
+	After  []Entry
+}
+
+// Search finds the newest entries containing every term in q
+func (a *Archive) Search(q Query) ([]Result, error) {
+	var words []string
+	for _, t := range q.Terms {
+		words = append(words, terms(t)...)
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	allowed := func(e Entry) bool {
+		if len(q.Kinds) == 0 {
+			return true
+		}
+		for _, k := range q.Kinds {
+			if e.Kind == k {
+				return true
+			}
+		}
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ids := a.intersect(words)
+	var results []Result
+	for i := len(ids) - 1; i >= 0 && len(results) < limit; i-- {
+		match, err := a.read(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if !allowed(match) {
+			continue
+		}
+		r := Result{Match: match}
+		if r.Before, err = a.around(match.ID, -1, q.Context, allowed); err != nil {
+			return nil, err
+		}
+		if r.After, err = a.around(match.ID, 1, q.Context, allowed); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// intersect returns the IDs in every posting list of words, in order
+func (a *Archive) intersect(words []string) []int64 {
+	lists := make([][]int64, 0, len(words))
+	for _, w := range words {
+		list := a.postings[w]
+		if len(list) == 0 {
+			return nil
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	ids := lists[0]
+	for _, list := range lists[1:] {
+		var both []int64
+		for _, id := range ids {
+			j := sort.Search(len(list), func(k int) bool { return list[k] >= id })
+			if j < len(list) && list[j] == id {
+				both = append(both, id)
+			}
+		}
+		ids = both
+	}
+	return ids
+}
+
+// around collects up to n allowed entries next to id walking in step's
+// direction, returned oldest first
+func (a *Archive) around(id int64, step int64, n int, allowed func(Entry) bool) ([]Entry, error) {
+	var found []Entry
+	for next := id + step; len(found) < n && next >= 0 && next < int64(len(a.offsets)); next += step {
+		e, err := a.read(next)
+		if err != nil {
+			return nil, err
+		}
+		if allowed(e) {
+			found = append(found, e)
+		}
+	}
+	if step < 0 {
+		for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+			found[i], found[j] = found[j], found[i]
+		}
+	}
+	return found, nil
+}
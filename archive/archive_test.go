@@ -0,0 +1,239 @@
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+var start = time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+
+func fill(t *testing.T, a *Archive, msgs ...parser.RoomMsg) {
+	for i, msg := range msgs {
+		if err := a.Add(start.Add(time.Duration(i)*time.Minute), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchWithContext(t *testing.T) {
+	a, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	fill(t, a,
+		parser.PublicMsg{From: "alice", Message: "should we use postgres?"},
+		parser.PrivateMsg{From: "mallory", Message: "psst, postgres"},
+		parser.PublicMsg{From: "bob", Message: "Decision: Postgres it is."},
+		parser.JoinMsg{Username: "carol", Status: parser.UserJoined},
+		parser.PublicMsg{From: "carol", Message: "what did I miss"},
+	)
+
+	results, err := a.Search(Query{Terms: []string{"postgres decision"}, Context: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Match.From != "bob" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if len(results[0].Before) != 1 || results[0].Before[0].Kind != KindPrivate {
+		t.Fatalf("unexpected context before: %+v", results[0].Before)
+	}
+	if len(results[0].After) != 1 || results[0].After[0].Kind != KindJoin {
+		t.Fatalf("unexpected context after: %+v", results[0].After)
+	}
+
+	results, err = a.Search(Query{Terms: []string{"postgres"}, Context: 1, Kinds: PublicKinds})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Match.From != "bob" || results[1].Match.From != "alice" {
+		t.Fatalf("unexpected public results: %+v", results)
+	}
+	if len(results[0].Before) != 1 || results[0].Before[0].From != "alice" {
+		t.Fatalf("private entry leaked into context: %+v", results[0].Before)
+	}
+}
+
+func TestIndexSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < snapshotEvery+3; i++ {
+		fill(t, a, parser.PublicMsg{From: "bot", Message: fmt.Sprintf("build %d passed", i)})
+	}
+	// no Close, the last entries are only in the log
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	for _, n := range []int{0, snapshotEvery + 2} {
+		results, err := reopened.Search(Query{Terms: []string{fmt.Sprint(n)}})
+		if err != nil || len(results) != 1 {
+			t.Fatalf("entry %d not found after reopening: %+v %v", n, results, err)
+		}
+	}
+}
+
+func TestPartialEntryIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, a, parser.PublicMsg{From: "alice", Message: "complete"})
+	a.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, entriesFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":1,"kind":"pub`)
+	f.Close()
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal("unable to open archive with a partial entry:", err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != 1 {
+		t.Fatalf("expected 1 entry, got %d", reopened.Len())
+	}
+	if _, err := reopened.Append(Entry{Kind: KindPublic, From: "bob", Message: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	results, err := reopened.Search(Query{Terms: []string{"after"}})
+	if err != nil || len(results) != 1 || results[0].Match.ID != 1 {
+		t.Fatalf("append after recovery failed: %+v %v", results, err)
+	}
+}
+
+func TestEntriesInRange(t *testing.T) {
+	a, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := a.Append(Entry{Time: start.Add(time.Duration(i) * time.Hour), Kind: KindPublic, From: "bob", Message: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err = a.Entries(start.Add(3*time.Hour), start.Add(6*time.Hour), func(e Entry) error {
+		got = append(got, e.Message)
+		return nil
+	})
+	if err != nil || fmt.Sprint(got) != "[3 4 5]" {
+		t.Fatalf("unexpected range: %q %v", got, err)
+	}
+}
+
+func TestReadOnlyOpenWhileAppending(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const total = 2000
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < total; i++ {
+			e := Entry{Time: start.Add(time.Duration(i) * time.Second), Kind: KindPublic, From: "alice", Message: fmt.Sprint("line ", i)}
+			if _, err := w.Append(e); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+		}
+		r, err := OpenReadOnly(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Search(Query{Terms: []string{"line"}, Limit: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Append(Entry{Kind: KindPublic}); err != ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got %v", err)
+		}
+		r.Close()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal("writer can't reopen the archive:", err)
+	}
+	defer reopened.Close()
+	var n int
+	err = reopened.Entries(time.Time{}, time.Time{}, func(e Entry) error {
+		if e.Message != fmt.Sprint("line ", n) {
+			return fmt.Errorf("entry %d is %q", n, e.Message)
+		}
+		n++
+		return nil
+	})
+	if err != nil || n != total {
+		t.Fatalf("read back %d of %d entries: %v", n, total, err)
+	}
+}
+
+func TestReadOnlyLeavesPartialEntry(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(t, w, parser.PublicMsg{From: "alice", Message: "complete"})
+	w.Close()
+
+	path := filepath.Join(dir, entriesFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":1,"kind":"pub`)
+	f.Close()
+	before, _ := os.Stat(path)
+	os.Remove(filepath.Join(dir, indexFile))
+
+	r, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 1 {
+		t.Fatalf("expected 1 complete entry, got %d", r.Len())
+	}
+	r.Close()
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Fatalf("read-only open changed the log from %d to %d bytes", before.Size(), after.Size())
+	}
+	if _, err := os.Stat(filepath.Join(dir, indexFile)); !os.IsNotExist(err) {
+		t.Fatal("read-only close saved an index")
+	}
+}
@@ -0,0 +1,131 @@
+// Package archive keeps every line of the room on disk with a full-text
+// index so old conversations can be searched and exported
+package archive
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+// Kind is what sort of room event an entry records
+type Kind string
+
+const (
+	// KindPublic is a message to the room
+	KindPublic Kind = "public"
+	// KindPrivate is a PM to the archiving user
+	KindPrivate Kind = "private"
+	// KindAction is a /me
+	KindAction Kind = "action"
+	// KindJoin is a user connecting
+	KindJoin Kind = "join"
+	// KindLeft is a user disconnecting
+	KindLeft Kind = "left"
+	// KindRename is a nick change, To holds the new nick
+	KindRename Kind = "rename"
+	// KindAway is a user going away, Message holds the reason
+	KindAway Kind = "away"
+	// KindBack is a user coming back from away
+	KindBack Kind = "back"
+	// KindSystem is a message from the server to the archiving user
+	KindSystem Kind = "system"
+)
+
+// PublicKinds are the kinds everybody in the room saw
+var PublicKinds = []Kind{KindPublic, KindAction, KindJoin, KindLeft, KindRename, KindAway, KindBack}
+
+// Entry is one archived room event, ID is its position in the archive
+type Entry struct {
+	ID      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Kind    Kind      `json:"kind"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// EntryFor converts a parsed line into an entry. Replies to the archiving
+// user's own queries, /whois and /names, and acks of its PMs carry nothing
+// worth keeping and are reported as not ok.
+func EntryFor(t time.Time, msg parser.RoomMsg) (Entry, bool) {
+	e := Entry{Time: t}
+	switch m := msg.(type) {
+	case parser.PublicMsg:
+		e.Kind, e.From, e.Message = KindPublic, m.From, m.Message
+	case parser.PrivateMsg:
+		e.Kind, e.From, e.Message = KindPrivate, m.From, m.Message
+	case parser.ActionMsg:
+		e.Kind, e.From, e.Message = KindAction, m.From, m.Message
+	case parser.JoinMsg:
+		e.Kind, e.From = KindJoin, m.Username
+		if m.Status == parser.UserLeft {
+			e.Kind = KindLeft
+		}
+	case parser.UsernameChangeMsg:
+		e.Kind, e.From, e.To = KindRename, m.FromUsername, m.ToUsername
+	case parser.AwayMsg:
+		e.Kind, e.From, e.Message = KindAway, m.Username, m.Reason
+		if !m.Away {
+			e.Kind = KindBack
+		}
+	case parser.AckMsg:
+		// the server echoes our own room messages back, the other users saw them
+		if m.Type != parser.AckMsgPublic {
+			return Entry{}, false
+		}
+		e.Kind, e.From, e.Message = KindPublic, m.Username, m.Message
+	case parser.SystemMsg:
+		e.Kind, e.Message = KindSystem, m.Message
+	default:
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// String renders the entry the way ssh-chat showed it
+func (e Entry) String() string {
+	switch e.Kind {
+	case KindPrivate:
+		return "[PM from " + e.From + "] " + e.Message
+	case KindAction:
+		return "** " + e.From + " " + e.Message
+	case KindJoin:
+		return " * " + e.From + " joined."
+	case KindLeft:
+		return " * " + e.From + " left."
+	case KindRename:
+		return " * " + e.From + " is now known as " + e.To + "."
+	case KindAway:
+		return "** " + e.From + " has gone away: " + e.Message
+	case KindBack:
+		return "** " + e.From + " is back."
+	case KindSystem:
+		return "-> " + e.Message
+	}
+	return e.From + ": " + e.Message
+}
+
+// terms splits text into the lowercased words the index is keyed on
+func terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// indexTerms is every distinct term an entry can be found by
+func (e Entry) indexTerms() []string {
+	seen := map[string]bool{}
+	var all []string
+	for _, text := range []string{e.From, e.To, e.Message} {
+		for _, term := range terms(text) {
+			if !seen[term] {
+				seen[term] = true
+				all = append(all, term)
+			}
+		}
+	}
+	return all
+}
@@ -0,0 +1,226 @@
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"time"
+)
+
+// Formats are the export formats NewExporter knows
+var Formats = []string{"jsonl", "irssi", "html"}
+
+// Exporter writes entries in one format, Close finishes the document and
+// has to be called even when nothing was written
+type Exporter interface {
+	Write(e Entry) error
+	Close() error
+}
+
+// ExportOptions tune how entries are rendered
+type ExportOptions struct {
+	// Location is the timezone times are shown in, nil means local time
+	Location *time.Location
+	// Title heads the HTML page
+	Title string
+}
+
+// NewExporter creates an exporter for format writing to w
+func NewExporter(format string, w io.Writer, opts ExportOptions) (Exporter, error) {
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.Title == "" {
+		opts.Title = "ssh-chat transcript"
+	}
+	buf := bufio.NewWriter(w)
+	switch format {
+	case "jsonl":
+		return &jsonlExporter{w: buf, enc: json.NewEncoder(buf)}, nil
+	case "irssi":
+		return &irssiExporter{w: buf, loc: opts.Location}, nil
+	case "html":
+		return &htmlExporter{w: buf, opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown export format '%s', use one of %v", format, Formats)
+}
+
+// Export writes the entries between from and to that have one of kinds,
+// all kinds when empty, and finishes the document
+func (a *Archive) Export(exp Exporter, from, to time.Time, kinds []Kind) error {
+	err := a.Entries(from, to, func(e Entry) error {
+		if len(kinds) > 0 && !hasKind(kinds, e.Kind) {
+			return nil
+		}
+		return exp.Write(e)
+	})
+	if closeErr := exp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func hasKind(kinds []Kind, kind Kind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonlExporter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (j *jsonlExporter) Write(e Entry) error {
+	return j.enc.Encode(e)
+}
+
+func (j *jsonlExporter) Close() error {
+	return j.w.Flush()
+}
+
+// irssiExporter writes logs the way irssi does, with day change markers
+type irssiExporter struct {
+	w       *bufio.Writer
+	loc     *time.Location
+	lastDay string
+}
+
+func (x *irssiExporter) Write(e Entry) error {
+	t := e.Time.In(x.loc)
+	if x.lastDay == "" {
+		fmt.Fprintf(x.w, "--- Log opened %s\n", t.Format("Mon Jan 02 15:04:05 2006"))
+	} else if day := t.Format("2006-01-02"); day != x.lastDay {
+		fmt.Fprintf(x.w, "--- Day changed %s\n", t.Format("Mon Jan 02 2006"))
+	}
+	x.lastDay = t.Format("2006-01-02")
+
+	var line string
+	switch e.Kind {
+	case KindPublic:
+		line = fmt.Sprintf("<%s> %s", e.From, e.Message)
+	case KindPrivate:
+		line = fmt.Sprintf("*%s* %s", e.From, e.Message)
+	case KindAction:
+		line = fmt.Sprintf(" * %s %s", e.From, e.Message)
+	case KindJoin:
+		line = fmt.Sprintf("-!- %s has joined", e.From)
+	case KindLeft:
+		line = fmt.Sprintf("-!- %s has quit", e.From)
+	case KindRename:
+		line = fmt.Sprintf("-!- %s is now known as %s", e.From, e.To)
+	case KindAway:
+		line = fmt.Sprintf("-!- %s is away: %s", e.From, e.Message)
+	case KindBack:
+		line = fmt.Sprintf("-!- %s is back", e.From)
+	default:
+		line = fmt.Sprintf("-!- %s", e.Message)
+	}
+	_, err := fmt.Fprintf(x.w, "%s %s\n", t.Format("15:04"), line)
+	return err
+}
+
+func (x *irssiExporter) Close() error {
+	if x.lastDay != "" {
+		fmt.Fprintf(x.w, "--- Log closed\n")
+	}
+	return x.w.Flush()
+}
+
+// htmlExporter writes a page with everything inline so it can be mailed or
+// hosted as a single file
+type htmlExporter struct {
+	w       *bufio.Writer
+	opts    ExportOptions
+	started bool
+	lastDay string
+}
+
+const htmlHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: monospace; background: #fdfdfd; color: #222; margin: 2em; }
+h1 { font-size: 1.2em; }
+.day { margin: 1em 0 0.5em; color: #888; border-bottom: 1px solid #ddd; }
+.line { white-space: pre-wrap; padding: 1px 0; }
+.line time { color: #999; margin-right: 0.5em; }
+.nick { font-weight: bold; }
+.action { font-style: italic; }
+.private { background: #f3f0ff; }
+.join, .left, .rename, .away, .back { color: #777; }
+.system { color: #a33; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+`
+
+func (h *htmlExporter) start() {
+	if !h.started {
+		title := html.EscapeString(h.opts.Title)
+		fmt.Fprintf(h.w, htmlHead, title, title)
+		h.started = true
+	}
+}
+
+func (h *htmlExporter) Write(e Entry) error {
+	h.start()
+	t := e.Time.In(h.opts.Location)
+	if day := t.Format("2006-01-02"); day != h.lastDay {
+		fmt.Fprintf(h.w, "<div class=\"day\">%s</div>\n", t.Format("Monday, January 2 2006"))
+		h.lastDay = day
+	}
+
+	msg := html.EscapeString(e.Message)
+	var body string
+	switch e.Kind {
+	case KindPublic:
+		body = fmt.Sprintf("%s: %s", nickHTML(e.From), msg)
+	case KindPrivate:
+		body = fmt.Sprintf("[PM from %s] %s", nickHTML(e.From), msg)
+	case KindAction:
+		body = fmt.Sprintf("** %s %s", nickHTML(e.From), msg)
+	case KindJoin:
+		body = fmt.Sprintf("* %s joined", nickHTML(e.From))
+	case KindLeft:
+		body = fmt.Sprintf("* %s left", nickHTML(e.From))
+	case KindRename:
+		body = fmt.Sprintf("* %s is now known as %s", nickHTML(e.From), nickHTML(e.To))
+	case KindAway:
+		body = fmt.Sprintf("* %s has gone away: %s", nickHTML(e.From), msg)
+	case KindBack:
+		body = fmt.Sprintf("* %s is back", nickHTML(e.From))
+	default:
+		body = "-&gt; " + msg
+	}
+	_, err := fmt.Fprintf(h.w, "<div class=\"line %s\"><time datetime=\"%s\">%s</time>%s</div>\n",
+		e.Kind, e.Time.UTC().Format(time.RFC3339), t.Format("15:04"), body)
+	return err
+}
+
+func (h *htmlExporter) Close() error {
+	h.start()
+	fmt.Fprint(h.w, "</body>\n</html>\n")
+	return h.w.Flush()
+}
+
+// nickHTML gives every nick its own stable colour
+func nickHTML(nick string) string {
+	return fmt.Sprintf("<span class=\"nick\" style=\"color: hsl(%d, 65%%, 38%%)\">%s</span>",
+		nickHue(nick), html.EscapeString(nick))
+}
+
+func nickHue(nick string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(nick))
+	return h.Sum32() % 360
+}
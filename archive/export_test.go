@@ -0,0 +1,115 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+func exportFixture(t *testing.T) *Archive {
+	a, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+
+	msgs := []parser.RoomMsg{
+		parser.JoinMsg{Username: "alice", Status: parser.UserJoined},
+		parser.PublicMsg{From: "alice", Message: "<b>hi</b>"},
+		parser.ActionMsg{From: "bob", Message: "waves"},
+		parser.PrivateMsg{From: "mallory", Message: "secret"},
+		parser.UsernameChangeMsg{FromUsername: "bob", ToUsername: "rob"},
+		parser.SystemMsg{Message: "Message rejected: Rate limiting is in effect."},
+		parser.JoinMsg{Username: "alice", Status: parser.UserLeft},
+	}
+	for i, msg := range msgs {
+		// the last line falls on the next day
+		at := start.Add(time.Duration(i) * time.Minute)
+		if i == len(msgs)-1 {
+			at = start.Add(24 * time.Hour)
+		}
+		if err := a.Add(at, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func export(t *testing.T, a *Archive, format string, from, to time.Time, kinds []Kind) string {
+	var out bytes.Buffer
+	exp, err := NewExporter(format, &out, ExportOptions{Location: time.UTC, Title: "standup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Export(exp, from, to, kinds); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestExportIrssi(t *testing.T) {
+	a := exportFixture(t)
+	got := export(t, a, "irssi", time.Time{}, time.Time{}, nil)
+	want := `--- Log opened Fri May 01 09:00:00 2020
+09:00 -!- alice has joined
+09:01 <alice> <b>hi</b>
+09:02  * bob waves
+09:03 *mallory* secret
+09:04 -!- bob is now known as rob
+09:05 -!- Message rejected: Rate limiting is in effect.
+--- Day changed Sat May 02 2020
+09:00 -!- alice has quit
+--- Log closed
+`
+	if got != want {
+		t.Fatalf("unexpected irssi log:\n%s", got)
+	}
+}
+
+func TestExportJSONLinesInRange(t *testing.T) {
+	a := exportFixture(t)
+	got := export(t, a, "jsonl", start.Add(time.Minute), start.Add(3*time.Minute), nil)
+
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in range, got:\n%s", got)
+	}
+	var e Entry
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.Kind != KindAction || e.From != "bob" {
+		t.Fatalf("unexpected entry %+v: %v", e, err)
+	}
+}
+
+func TestExportHTML(t *testing.T) {
+	a := exportFixture(t)
+	got := export(t, a, "html", time.Time{}, time.Time{}, PublicKinds)
+
+	for _, want := range []string{
+		"<title>standup</title>",
+		"&lt;b&gt;hi&lt;/b&gt;",
+		`<div class="line action">`,
+		`<div class="line rename">`,
+		"Saturday, May 2 2020",
+		"</html>",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("html is missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "secret") || strings.Contains(got, "Rate limiting") {
+		t.Fatalf("html has entries outside the requested kinds:\n%s", got)
+	}
+	if strings.Count(got, nickHTML("alice")) != 3 {
+		t.Fatalf("alice is not coloured the same everywhere:\n%s", got)
+	}
+}
+
+func TestUnknownExportFormat(t *testing.T) {
+	if _, err := NewExporter("pdf", &bytes.Buffer{}, ExportOptions{}); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
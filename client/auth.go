@@ -0,0 +1,321 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SignerSource supplies the keys offered to the server during authentication
+type SignerSource interface {
+	Signers() ([]ssh.Signer, error)
+	String() string
+}
+
+// Passphrase returns the passphrase used to decrypt a private key
+type Passphrase func() ([]byte, error)
+
+// PassphraseFromEnv reads the passphrase from the named environment variable
+func PassphraseFromEnv(name string) Passphrase {
+	return func() ([]byte, error) {
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("passphrase environment variable %s is not set", name)
+		}
+		return []byte(val), nil
+	}
+}
+
+// PassphraseFromFile reads the passphrase from the first line of a file
+func PassphraseFromFile(path string) Passphrase {
+	return func() ([]byte, error) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read passphrase file: %w", err)
+		}
+		line := strings.SplitN(string(content), "\n", 2)[0]
+		return []byte(strings.TrimRight(line, "\r")), nil
+	}
+}
+
+type keyFileSource struct {
+	path       string
+	passphrase Passphrase
+}
+
+// KeyFile loads a private key of any type ssh understands from path,
+// passphrase is only used when the key is encrypted and may be nil
+func KeyFile(path string, passphrase Passphrase) SignerSource {
+	return &keyFileSource{path: path, passphrase: passphrase}
+}
+
+func (k *keyFileSource) String() string {
+	return "key file " + k.path
+}
+
+func (k *keyFileSource) Signers() ([]ssh.Signer, error) {
+	key, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read private key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if k.passphrase == nil {
+			return nil, fmt.Errorf("private key is encrypted and no passphrase was configured")
+		}
+		var passphrase []byte
+		passphrase, err = k.passphrase()
+		if err != nil {
+			return nil, err
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+type identitySource struct {
+	path string
+}
+
+// Identity uses the bot's own key at path, generating it on first use. In
+// a chain the key is only generated when no source before it had a key.
+func Identity(path string) SignerSource {
+	return &identitySource{path: path}
+}
+
+func (i *identitySource) exists() bool {
+	_, err := os.Stat(i.path)
+	return err == nil
+}
+
+func (i *identitySource) String() string {
+	return "identity " + i.path
+}
+
+func (i *identitySource) Signers() ([]ssh.Signer, error) {
+	signer, err := LoadOrCreateIdentity(i.path)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+type agentSource struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// Agent offers every key held by the ssh-agent listening on SSH_AUTH_SOCK
+func Agent() SignerSource {
+	return &agentSource{}
+}
+
+func (a *agentSource) String() string {
+	return "ssh-agent"
+}
+
+func (a *agentSource) Signers() ([]ssh.Signer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ssh-agent: %w", err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to list ssh-agent keys: %w", err)
+	}
+
+	// the agent signs over this connection, it stays open until the handshake is done
+	a.mu.Lock()
+	a.conns = append(a.conns, conn)
+	a.mu.Unlock()
+
+	return signers, nil
+}
+
+// Close drops the connections opened to the agent
+func (a *agentSource) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, conn := range a.conns {
+		conn.Close()
+	}
+	a.conns = nil
+	return nil
+}
+
+// AuthConfig describes authentication the way config files and command line
+// flags spell it. Methods are tried in order and are one of "agent", "key"
+// (every entry of KeyFiles) or "identity" (the bot's generated key).
+type AuthConfig struct {
+	Methods        []string
+	KeyFiles       []string
+	PassphraseEnv  string
+	PassphraseFile string
+	IdentityFile   string
+}
+
+// Sources converts the config to signer sources, no methods means the
+// default chain is used and nil is returned
+func (a AuthConfig) Sources() ([]SignerSource, error) {
+	var passphrase Passphrase
+	switch {
+	case a.PassphraseEnv != "" && a.PassphraseFile != "":
+		return nil, fmt.Errorf("only one of passphrase env and passphrase file can be set")
+	case a.PassphraseEnv != "":
+		passphrase = PassphraseFromEnv(a.PassphraseEnv)
+	case a.PassphraseFile != "":
+		passphrase = PassphraseFromFile(expandHome(a.PassphraseFile))
+	}
+
+	identityPath := expandHome(a.IdentityFile)
+	if identityPath == "" {
+		identityPath = defaultIdentityPath()
+	}
+
+	var sources []SignerSource
+	for _, method := range a.Methods {
+		switch method {
+		case "agent":
+			sources = append(sources, Agent())
+		case "key":
+			if len(a.KeyFiles) == 0 {
+				return nil, fmt.Errorf("auth method 'key' needs at least one key file")
+			}
+			for _, path := range a.KeyFiles {
+				sources = append(sources, KeyFile(expandHome(path), passphrase))
+			}
+		case "identity":
+			sources = append(sources, Identity(identityPath))
+		default:
+			return nil, fmt.Errorf("unknown auth method '%s'", method)
+		}
+	}
+	return sources, nil
+}
+
+// expandHome replaces a leading ~/ with the user's home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, path[2:])
+}
+
+func defaultSignerSources(identityPath string) []SignerSource {
+	sources := []SignerSource{}
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			sources = append(sources, KeyFile(filepath.Join(homeDir, ".ssh", name), nil))
+		}
+	}
+	return append(sources, Identity(identityPath))
+}
+
+// authChain offers the keys of every source in order, sources that fail are
+// skipped and the bot's identity isn't generated when another source has a
+// key. It remembers which key the server asked to sign with.
+type authChain struct {
+	sources []SignerSource
+
+	mu   sync.Mutex
+	used ssh.Signer
+}
+
+func (a *authChain) signers() ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	var failures []string
+	for _, source := range a.sources {
+		if id, ok := source.(*identitySource); ok && len(signers) > 0 && !id.exists() {
+			continue
+		}
+		s, err := source.Signers()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		for _, signer := range s {
+			signers = append(signers, &recordingSigner{Signer: signer, chain: a})
+		}
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no usable ssh keys: %s", strings.Join(failures, "; "))
+	}
+	return signers, nil
+}
+
+// authMethod checks that some key is usable before connecting so a missing
+// key is reported as such instead of as a failed handshake
+func (a *authChain) authMethod() (ssh.AuthMethod, error) {
+	if _, err := a.signers(); err != nil {
+		return nil, err
+	}
+	a.close()
+	return ssh.PublicKeysCallback(a.signers), nil
+}
+
+func (a *authChain) usedSigner() ssh.Signer {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used
+}
+
+func (a *authChain) close() {
+	for _, source := range a.sources {
+		if closer, ok := source.(interface{ Close() error }); ok {
+			closer.Close()
+		}
+	}
+}
+
+type recordingSigner struct {
+	ssh.Signer
+	chain *authChain
+}
+
+func (r *recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return r.record(r.Signer.Sign(rand, data))
+}
+
+// SignWithAlgorithm keeps rsa-sha2 signatures available for wrapped rsa keys
+func (r *recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	as, ok := r.Signer.(ssh.AlgorithmSigner)
+	if !ok {
+		if algorithm != "" && algorithm != r.PublicKey().Type() {
+			return nil, fmt.Errorf("key does not support signature algorithm %s", algorithm)
+		}
+		return r.Sign(rand, data)
+	}
+	return r.record(as.SignWithAlgorithm(rand, data, algorithm))
+}
+
+func (r *recordingSigner) record(sig *ssh.Signature, err error) (*ssh.Signature, error) {
+	if err == nil {
+		r.chain.mu.Lock()
+		r.chain.used = r.Signer
+		r.chain.mu.Unlock()
+	}
+	return sig, err
+}
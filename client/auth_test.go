@@ -0,0 +1,215 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testPassphrase = "correct horse"
+
+// writeEncryptedKey generates a key encrypted with testPassphrase and
+// returns its path and fingerprint
+func writeEncryptedKey(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// x/crypto can't write encrypted openssh keys yet, ssh still reads legacy encrypted PEM
+	block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte(testPassphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, Fingerprint(pub)
+}
+
+func setenv(t *testing.T, name, value string) {
+	os.Setenv(name, value)
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func TestKeyFilePassphraseFromEnv(t *testing.T) {
+	path, fingerprint := writeEncryptedKey(t)
+	setenv(t, "NOTIFY_TEST_PASSPHRASE", testPassphrase)
+
+	signers, err := KeyFile(path, PassphraseFromEnv("NOTIFY_TEST_PASSPHRASE")).Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Fingerprint(signers[0].PublicKey()); got != fingerprint {
+		t.Fatalf("decrypted the wrong key: %s", got)
+	}
+}
+
+func TestKeyFilePassphraseFromFile(t *testing.T) {
+	path, fingerprint := writeEncryptedKey(t)
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := ioutil.WriteFile(passphraseFile, []byte(testPassphrase+"\r\nignored\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signers, err := KeyFile(path, PassphraseFromFile(passphraseFile)).Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Fingerprint(signers[0].PublicKey()); got != fingerprint {
+		t.Fatalf("decrypted the wrong key: %s", got)
+	}
+}
+
+func TestKeyFilePassphraseErrors(t *testing.T) {
+	path, _ := writeEncryptedKey(t)
+	setenv(t, "NOTIFY_TEST_WRONG", "wrong")
+
+	cases := map[string]struct {
+		passphrase Passphrase
+		want       string
+	}{
+		"none":      {nil, "no passphrase was configured"},
+		"unset env": {PassphraseFromEnv("NOTIFY_TEST_UNSET"), "NOTIFY_TEST_UNSET is not set"},
+		"no file":   {PassphraseFromFile(filepath.Join(t.TempDir(), "missing")), "unable to read passphrase file"},
+		"wrong":     {PassphraseFromEnv("NOTIFY_TEST_WRONG"), "unable to parse private key"},
+	}
+	for name, c := range cases {
+		_, err := KeyFile(path, c.passphrase).Signers()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, c.want, err)
+		}
+	}
+}
+
+func TestAuthConfigSources(t *testing.T) {
+	sources, err := AuthConfig{
+		Methods:      []string{"agent", "key", "identity"},
+		KeyFiles:     []string{"a", "b"},
+		IdentityFile: "bot",
+	}.Sources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range sources {
+		names = append(names, s.String())
+	}
+	if got := strings.Join(names, ", "); got != "ssh-agent, key file a, key file b, identity bot" {
+		t.Fatalf("unexpected sources: %s", got)
+	}
+
+	if sources, err := (AuthConfig{}).Sources(); err != nil || sources != nil {
+		t.Fatalf("no methods should mean the default chain, got %v %v", sources, err)
+	}
+}
+
+func TestAuthConfigSourcesErrors(t *testing.T) {
+	cases := map[string]struct {
+		config AuthConfig
+		want   string
+	}{
+		"two passphrases": {AuthConfig{Methods: []string{"key"}, KeyFiles: []string{"a"}, PassphraseEnv: "X", PassphraseFile: "y"}, "only one of passphrase env and passphrase file"},
+		"no key files":    {AuthConfig{Methods: []string{"key"}}, "needs at least one key file"},
+		"unknown method":  {AuthConfig{Methods: []string{"password"}}, "unknown auth method 'password'"},
+	}
+	for name, c := range cases {
+		_, err := c.config.Sources()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, c.want, err)
+		}
+	}
+}
+
+func TestAuthFallsBackToWorkingSource(t *testing.T) {
+	server := startTestServer(t)
+	path, fingerprint := writeEncryptedKey(t)
+	setenv(t, "NOTIFY_TEST_PASSPHRASE", testPassphrase)
+	dir := t.TempDir()
+
+	c, err := CreateClient(server.Addr(), "tester", testOptions(t, WithAuth(
+		KeyFile(filepath.Join(dir, "missing"), nil),
+		KeyFile(path, nil),
+		KeyFile(path, PassphraseFromEnv("NOTIFY_TEST_PASSPHRASE")),
+	))...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	defer c.Close()
+	if c.Fingerprint() != fingerprint {
+		t.Fatalf("authenticated with %s instead of the decrypted key", c.Fingerprint())
+	}
+}
+
+func TestAuthReportsEverySourceThatFailed(t *testing.T) {
+	server := startTestServer(t)
+	dir := t.TempDir()
+
+	_, err := CreateClient(server.Addr(), "tester", testOptions(t, WithAuth(
+		KeyFile(filepath.Join(dir, "first"), nil),
+		KeyFile(filepath.Join(dir, "second"), nil),
+	))...)
+	if err == nil {
+		t.Fatal("connected without a usable key")
+	}
+	for _, want := range []string{"no usable ssh keys", "first", "second"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %q: %v", want, err)
+		}
+	}
+}
+
+func TestIdentityOnlyCreatedWhenNeeded(t *testing.T) {
+	server := startTestServer(t)
+	dir := t.TempDir()
+	userKey := filepath.Join(dir, "id_ed25519")
+	user, err := LoadOrCreateIdentity(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := filepath.Join(dir, identityFileName)
+
+	c, err := CreateClient(server.Addr(), "tester", testOptions(t, WithAuth(KeyFile(userKey, nil), Identity(identity)))...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	c.Close()
+	if c.Fingerprint() != Fingerprint(user.PublicKey()) {
+		t.Fatalf("authenticated with %s instead of the user's key", c.Fingerprint())
+	}
+	if _, err := os.Stat(identity); !os.IsNotExist(err) {
+		t.Fatal("identity was generated although the user's key works:", err)
+	}
+
+	c, err = CreateClient(server.Addr(), "tester", testOptions(t, WithAuth(KeyFile(filepath.Join(dir, "missing"), nil), Identity(identity)))...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	c.Close()
+	if _, err := os.Stat(identity); err != nil {
+		t.Fatal("identity was not generated when nothing else worked:", err)
+	}
+
+	// once it exists the identity is offered after the user's key again
+	chain := &authChain{sources: []SignerSource{KeyFile(userKey, nil), Identity(identity)}}
+	if signers, err := chain.signers(); err != nil || len(signers) != 2 {
+		t.Fatalf("expected both keys to be offered, got %d: %v", len(signers), err)
+	}
+}
@@ -2,18 +2,15 @@ package client
 
 import (
 	"bufio"
-	"crypto/rand"
-	"crypto/rsa"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
-	"os"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/lunixbochs/vtclean"
 	"github.com/pkg/errors"
-	"github.com/shazow/rateio"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -22,21 +19,47 @@ const discardEcho = true
 
 // Client is used to communicate with ssh-chat or other ssh-sessions
 type Client struct {
+	// accessed atomically, kept first for alignment
+	linesRead    int64
+	lastActivity int64
+
 	conn    net.Conn
 	client  *ssh.Client
 	session *ssh.Session
+	signer  ssh.Signer
 
 	scanner *bufio.Scanner
 	writer  io.Writer
 
 	err error
 
-	ratelimit rateio.Limiter
+	bucket *tokenBucket
+	queue  *sendQueue
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    chan struct{}
+
+	failMu  sync.Mutex
+	failure error
 }
 
 // CreateClient establishes a connections with the destination as the given username
-func CreateClient(destination, username string) (*Client, error) {
-	client, conn, err := createSSHClient(destination, username)
+func CreateClient(destination, username string, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid keepalive")
+	}
+
+	auth := &authChain{sources: o.auth}
+	if len(auth.sources) == 0 {
+		auth.sources = defaultSignerSources(o.identityPath)
+	}
+
+	client, conn, err := createSSHClient(destination, username, auth, o)
 	if err != nil {
 		if conn != nil {
 			conn.Close()
@@ -54,35 +77,50 @@ func CreateClient(destination, username string) (*Client, error) {
 		return nil, errors.Wrap(err, "unable to open read/write connection to the session")
 	}
 
-	return &Client{
-		conn:      conn,
-		client:    client,
-		session:   session,
-		scanner:   bufio.NewScanner(r),
-		writer:    w,
-		ratelimit: rateio.NewSimpleLimiter(3, time.Second*3),
-	}, nil
+	c := &Client{
+		conn:    conn,
+		client:  client,
+		session: session,
+		signer:  auth.usedSigner(),
+		scanner: bufio.NewScanner(r),
+		writer:  w,
+		bucket:  newTokenBucket(bucketCapacity, bucketRefill),
+		queue:   newSendQueue(),
+		closed:  make(chan struct{}),
+	}
+	c.touch()
+	if o.keepaliveInterval > 0 {
+		go c.keepalive(o.keepaliveInterval, o.idleTimeout)
+	}
+	return c, nil
 }
 
-func createSSHClient(dest, username string) (*ssh.Client, net.Conn, error) {
-	signer, err := getSigner()
+func createSSHClient(dest, username string, auth *authChain, o *options) (*ssh.Client, net.Conn, error) {
+	hostKeys, err := newHostKeyChecker(o.knownHostsPath, o.hostKeyMode)
 	if err != nil {
-		signer, err = genSinger()
-		if err != nil {
-			return nil, nil, errors.Wrapf(err, "unable to get signer and then generate it")
-		}
+		return nil, nil, err
+	}
+
+	authMethod, err := auth.authMethod()
+	if err != nil {
+		return nil, nil, err
 	}
+	defer auth.close()
 
 	config := &ssh.ClientConfig{
 		User:            username,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Auth:            []ssh.AuthMethod{authMethod},
+		HostKeyCallback: hostKeys.callback,
 	}
 	conn, err := net.DialTimeout("tcp", dest, config.Timeout)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "unable to estable tcp connection to ssh server")
 	}
+	config.HostKeyAlgorithms = hostKeys.algorithms(dest, conn.RemoteAddr())
 	c, chans, reqs, err := ssh.NewClientConn(conn, dest, config)
+	if hostKeyErr := hostKeys.lastError(); hostKeyErr != nil {
+		return nil, conn, hostKeyErr
+	}
 	if err != nil {
 		return nil, conn, errors.Wrap(err, "unable to create ssh client conn")
 	}
@@ -91,14 +129,26 @@ func createSSHClient(dest, username string) (*ssh.Client, net.Conn, error) {
 	return client, conn, nil
 }
 
+// Fingerprint returns the fingerprint of the key the client authenticated
+// with, it is empty when the server didn't ask for a key
+func (c *Client) Fingerprint() string {
+	if c.signer == nil {
+		return ""
+	}
+	return Fingerprint(c.signer.PublicKey())
+}
+
 // ScanLine reads the connection till the next new line
 func (c *Client) ScanLine() (string, error) {
 	if c.err != nil {
 		return "", c.err
 	}
-	// c.conn.SetReadDeadline(time.Now().Add(30 * time.Minute))
 
 	continueReading := c.scanner.Scan()
+	if failure := c.failureErr(); failure != nil {
+		c.err = failure
+		return "", c.err
+	}
 	if c.scanner.Err() != nil {
 		c.err = c.scanner.Err()
 		return "", c.err
@@ -108,14 +158,21 @@ func (c *Client) ScanLine() (string, error) {
 		return "", c.err
 	}
 
+	c.touch()
+	atomic.AddInt64(&c.linesRead, 1)
 	cleanedLine := vtclean.Clean(c.scanner.Text(), noColor)
 	return cleanedLine, nil
 }
 
-// WriteLine send the given line to ssh-chat
+// LinesRead returns how many lines have been read from the server
+func (c *Client) LinesRead() int64 {
+	return atomic.LoadInt64(&c.linesRead)
+}
+
+// WriteLine send the given line to ssh-chat, waiting while over the rate limit
 func (c *Client) WriteLine(line string) error {
-	if c.ratelimit.Count(1) != nil {
-		time.Sleep(1 * time.Second)
+	if err := c.bucket.wait(context.Background()); err != nil {
+		return err
 	}
 	return c.writeLine(line)
 }
@@ -128,8 +185,16 @@ func (c *Client) writeLine(line string) error {
 	return nil
 }
 
-// Close disconnects the client
+// Close disconnects the client, it is safe to call more than once
 func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+func (c *Client) close() error {
 	err := c.session.Close()
 	if err != nil && err != io.EOF {
 		return errors.Wrap(err, "unable to close underlying ssh session")
@@ -160,30 +225,3 @@ func createSessionIO(session *ssh.Session) (io.Reader, io.WriteCloser, error) {
 	err = session.RequestPty("xterm", 80, 40, ssh.TerminalModes{})
 	return r, w, err
 }
-
-func getSigner() (ssh.Signer, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, fmt.Errorf("unable to find user's home dir for locating ssh key: %w", err)
-	}
-
-	key, err := ioutil.ReadFile(homeDir + "/.ssh/id_rsa")
-	if err != nil {
-		return nil, fmt.Errorf("unable to read local ssh key: %w", err)
-	}
-
-	signer, err := ssh.ParsePrivateKey(key)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse private key: %w", err)
-	}
-	return signer, nil
-}
-
-func genSinger() (ssh.Signer, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2014)
-	if err != nil {
-		return nil, fmt.Errorf("unable to generate rsa key: %w", err)
-	}
-	return ssh.NewSignerFromKey(key)
-
-}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/parser"
+	"github.com/voldyman/ssh-chat-notify/testutil"
+)
+
+func startServer(t *testing.T) *testutil.ChatServer {
+	server, err := testutil.NewChatServer()
+	if err != nil {
+		t.Fatal("unable to start chat server:", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestRunDeliversEventsAndAcks(t *testing.T) {
+	server := startServer(t)
+	c, err := CreateClient(server.Addr(), "tester", testOptions(t)...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events := make(chan Event, 16)
+	runErr := make(chan error, 1)
+	go func() { runErr <- c.Run(ctx, events) }()
+
+	if err := server.WaitForConnection(ctx, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	server.Join("alice")
+	server.Say("alice", "hello: world")
+
+	waitForEvent(ctx, t, events, func(msg parser.RoomMsg) bool {
+		pub, ok := msg.(parser.PublicMsg)
+		return ok && pub.From == "alice" && pub.Message == "hello: world"
+	})
+
+	delivery, err := c.SendPriority(ctx, "/msg alice hi there", PriorityReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Wait(ctx); err != nil {
+		t.Fatal("private message was not acknowledged:", err)
+	}
+
+	delivery, err = c.Send(ctx, "/msg nobody hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = delivery.Wait(ctx)
+	if !errors.Is(err, ErrRejected) || !strings.HasSuffix(err.Error(), "user not found") {
+		t.Fatal("expected the message to unknown user to be rejected, got:", err)
+	}
+
+	cancel()
+	if err := <-runErr; !errors.Is(err, context.Canceled) {
+		t.Fatal("expected run to stop with context.Canceled, got:", err)
+	}
+}
+
+func TestCommandErrorDoesNotRejectLaterLine(t *testing.T) {
+	server := startServer(t)
+	c, err := CreateClient(server.Addr(), "tester", testOptions(t)...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events := make(chan Event, 16)
+	go c.Run(ctx, events)
+	go func() {
+		for range events {
+		}
+	}()
+	if err := server.WaitForConnection(ctx, "tester"); err != nil {
+		t.Fatal(err)
+	}
+	server.Join("alice")
+
+	// ssh-chat answers the /whois with an error, which is not about the /msg
+	whois, _ := c.SendPriority(ctx, "/whois nobody", PriorityReply)
+	msg, _ := c.Send(ctx, "/msg alice hi")
+	if err := whois.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Wait(ctx); err != nil {
+		t.Fatal("private message was not acknowledged:", err)
+	}
+}
+
+func TestAnswerBeforeWriteReturns(t *testing.T) {
+	q := newSendQueue()
+	item := newOutgoingLine("/msg alice hi", PriorityNormal)
+
+	q.sending(item)
+	q.confirm(func(it *outgoingLine) bool { return it.recipient == "alice" })
+	q.sent(item)
+
+	select {
+	case <-item.delivery.Done():
+		if err := item.delivery.Err(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("ack read before the write returned was dropped")
+	}
+}
+
+func TestRateLimitedLineIsResent(t *testing.T) {
+	server := startServer(t)
+	server.SetRateLimit(1, time.Second)
+
+	c, err := CreateClient(server.Addr(), "tester", testOptions(t)...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	events := make(chan Event, 64)
+	go c.Run(ctx, events)
+	go func() {
+		for range events {
+		}
+	}()
+
+	first, _ := c.Send(ctx, "first")
+	second, _ := c.Send(ctx, "second")
+	for _, d := range []*Delivery{first, second} {
+		if err := d.Wait(ctx); err != nil {
+			t.Fatal("line was not delivered:", err)
+		}
+	}
+
+	rejected := 0
+	for _, r := range server.Received() {
+		if r.Line == "second" {
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Fatalf("expected the second line to be sent twice, it was sent %d times", rejected)
+	}
+}
+
+func waitForEvent(ctx context.Context, t *testing.T, events <-chan Event, matches func(parser.RoomMsg) bool) {
+	t.Helper()
+	for {
+		select {
+		case event := <-events:
+			if matches(event.Msg) {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("expected event never arrived")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrAckTimeout is returned when ssh-chat didn't echo a line in time
+var ErrAckTimeout = errors.New("no acknowledgement from server")
+
+// ErrRateLimited is returned when ssh-chat kept rejecting a line
+var ErrRateLimited = errors.New("line rejected by server rate limit")
+
+// ErrRejected is returned when ssh-chat refused a line, the error names
+// ssh-chat's reason
+var ErrRejected = errors.New("line rejected by server")
+
+// Delivery tracks a queued line until ssh-chat confirms it by echoing it
+// back, or until it times out or is rejected. Commands ssh-chat doesn't echo
+// are considered delivered once written.
+type Delivery struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{})}
+}
+
+func (d *Delivery) resolve(err error) {
+	d.once.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
+
+// Done is closed once the delivery succeeded or failed
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns why the delivery failed, it is nil until Done is closed
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the line was delivered or failed
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expectsAck reports whether ssh-chat echoes the line back, which is the
+// case for room messages and private messages but not for other commands
+func expectsAck(line string) bool {
+	return strings.HasPrefix(line, "/msg ") || !strings.HasPrefix(line, "/")
+}
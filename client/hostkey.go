@@ -0,0 +1,244 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMode decides what happens when the server's host key is checked
+type HostKeyMode int
+
+const (
+	// HostKeyTOFU trusts the first key seen for a host, pins it in the
+	// known_hosts file and refuses any different key after that
+	HostKeyTOFU HostKeyMode = iota
+	// HostKeyStrict only accepts hosts already listed in the known_hosts file
+	HostKeyStrict
+	// HostKeyInsecure accepts any host key, only use it for local testing
+	HostKeyInsecure
+)
+
+func (m HostKeyMode) String() string {
+	switch m {
+	case HostKeyTOFU:
+		return "tofu"
+	case HostKeyStrict:
+		return "strict"
+	case HostKeyInsecure:
+		return "insecure"
+	}
+	return "undef"
+}
+
+// ParseHostKeyMode converts the name of a mode as used in config files to a HostKeyMode
+func ParseHostKeyMode(name string) (HostKeyMode, error) {
+	switch name {
+	case "", "tofu":
+		return HostKeyTOFU, nil
+	case "strict":
+		return HostKeyStrict, nil
+	case "insecure":
+		return HostKeyInsecure, nil
+	}
+	return HostKeyTOFU, fmt.Errorf("unknown host key mode '%s'", name)
+}
+
+// HostKeyMismatchError is returned when the server presents a key that
+// differs from the one recorded in the known_hosts file
+type HostKeyMismatchError struct {
+	Host        string
+	KnownHosts  string
+	Fingerprint string
+	Want        []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key for %s does not match %s: got %s, want one of %v",
+		e.Host, e.KnownHosts, e.Fingerprint, e.Want)
+}
+
+// UnknownHostError is returned in strict mode when the host is not listed in
+// the known_hosts file
+type UnknownHostError struct {
+	Host        string
+	KnownHosts  string
+	Fingerprint string
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("host %s with key %s is not listed in %s", e.Host, e.Fingerprint, e.KnownHosts)
+}
+
+func defaultKnownHostsPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".ssh", "known_hosts")
+}
+
+// hostKeyChecker verifies host keys against a known_hosts file. The ssh
+// package flattens callback errors into strings, so the last typed error is
+// kept around for CreateClient to return.
+type hostKeyChecker struct {
+	path string
+	mode HostKeyMode
+
+	mu  sync.Mutex
+	err error
+}
+
+func newHostKeyChecker(path string, mode HostKeyMode) (*hostKeyChecker, error) {
+	if mode != HostKeyInsecure && path == "" {
+		return nil, errors.New("no known_hosts file configured")
+	}
+	return &hostKeyChecker{path: path, mode: mode}, nil
+}
+
+func (h *hostKeyChecker) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	err := h.check(hostname, remote, key)
+
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+
+	return err
+}
+
+// lastError returns the typed error of the last failed check
+func (h *hostKeyChecker) lastError() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+func (h *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if h.mode == HostKeyInsecure {
+		return nil
+	}
+
+	// serialize checks so two connections can't both pin a key for the same host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := ensureFile(h.path); err != nil {
+		return errors.Wrapf(err, "unable to create known_hosts file %s", h.path)
+	}
+	cb, err := knownhosts.New(h.path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read known_hosts file %s", h.path)
+	}
+
+	err = cb(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	if len(keyErr.Want) > 0 {
+		want := make([]string, 0, len(keyErr.Want))
+		for _, k := range keyErr.Want {
+			want = append(want, ssh.FingerprintSHA256(k.Key))
+		}
+		return &HostKeyMismatchError{
+			Host:        hostname,
+			KnownHosts:  h.path,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Want:        want,
+		}
+	}
+
+	if h.mode == HostKeyStrict {
+		return &UnknownHostError{
+			Host:        hostname,
+			KnownHosts:  h.path,
+			Fingerprint: ssh.FingerprintSHA256(key),
+		}
+	}
+
+	return pinHostKey(h.path, hostname, remote, key)
+}
+
+// algorithms lists the host key algorithms of the keys known_hosts has for
+// the host, nil when it has none. Without this the server picks the key type
+// and a host pinned with one type that also has another would be reported as
+// changed.
+func (h *hostKeyChecker) algorithms(hostname string, remote net.Addr) []string {
+	if h.mode == HostKeyInsecure {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cb, err := knownhosts.New(h.path)
+	if err != nil {
+		return nil
+	}
+	// the error for a key that can't be pinned lists the keys that are
+	var keyErr *knownhosts.KeyError
+	if !errors.As(cb(hostname, remote, probeKey), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		algorithms = append(algorithms, keyAlgorithms(known.Key.Type())...)
+	}
+	return algorithms
+}
+
+// probeKey is an ed25519 key nobody holds, checking it against known_hosts
+// reveals the keys pinned for a host
+var probeKey, _ = ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+
+// keyAlgorithms returns the signature algorithms a host key of keyType
+// can be negotiated with
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+func pinHostKey(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open known_hosts file %s", path)
+	}
+	defer f.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && remote.String() != hostname {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+
+	_, err = f.WriteString(knownhosts.Line(addresses, key) + "\n")
+	if err != nil {
+		return errors.Wrapf(err, "unable to pin host key in %s", path)
+	}
+	return nil
+}
+
+func ensureFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, nil, 0600)
+}
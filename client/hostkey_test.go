@@ -0,0 +1,104 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func writeKnownHosts(t *testing.T, addr string, keys ...ssh.PublicKey) string {
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key))
+	}
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTrustOnFirstUsePinsHostKey(t *testing.T) {
+	server := startTestServer(t)
+	opts := testOptions(t)
+
+	for i := 0; i < 2; i++ {
+		c, err := CreateClient(server.Addr(), "tester", opts...)
+		if err != nil {
+			t.Fatal("unable to connect:", err)
+		}
+		c.Close()
+	}
+
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	pinned, err := ioutil.ReadFile(o.knownHostsPath)
+	if err != nil {
+		t.Fatal("known_hosts was not written:", err)
+	}
+	if lines := strings.Count(string(pinned), "\n"); lines != 1 {
+		t.Fatalf("expected one pinned key, got %d lines: %s", lines, pinned)
+	}
+}
+
+func TestStrictModeRejectsUnknownHost(t *testing.T) {
+	server := startTestServer(t)
+
+	_, err := CreateClient(server.Addr(), "tester", testOptions(t, WithHostKeyMode(HostKeyStrict))...)
+	var unknown *UnknownHostError
+	if !errors.As(err, &unknown) {
+		t.Fatal("expected UnknownHostError, got:", err)
+	}
+}
+
+func TestChangedHostKeyIsRejected(t *testing.T) {
+	server := startTestServer(t)
+	knownHosts := writeKnownHosts(t, server.Addr(), newTestKey(t).PublicKey())
+
+	_, err := CreateClient(server.Addr(), "tester", testOptions(t, WithKnownHosts(knownHosts))...)
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatal("expected HostKeyMismatchError, got:", err)
+	}
+}
+
+func TestPinnedKeyTypeIsNegotiated(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preferred, err := ssh.NewSignerFromKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := newTestKey(t)
+	// the client would pick ecdsa over ed25519 on its own
+	server := startTestServer(t, preferred, pinned)
+	knownHosts := writeKnownHosts(t, server.Addr(), pinned.PublicKey())
+
+	c, err := CreateClient(server.Addr(), "tester", testOptions(t, WithKnownHosts(knownHosts), WithHostKeyMode(HostKeyStrict))...)
+	if err != nil {
+		t.Fatal("host with the pinned key was rejected:", err)
+	}
+	c.Close()
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	if got := keyAlgorithms(ssh.KeyAlgoRSA); !reflect.DeepEqual(got, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}) {
+		t.Fatalf("an rsa key allows %v", got)
+	}
+	if got := keyAlgorithms(ssh.KeyAlgoED25519); !reflect.DeepEqual(got, []string{ssh.KeyAlgoED25519}) {
+		t.Fatalf("an ed25519 key allows %v", got)
+	}
+}
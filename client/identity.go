@@ -0,0 +1,80 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const identityFileName = "ssh-chat-notify_ed25519"
+
+func defaultIdentityPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".ssh", identityFileName)
+}
+
+// LoadOrCreateIdentity reads the bot's private key from path, when the file
+// doesn't exist a new ed25519 key is generated and saved there so the bot keeps
+// the same fingerprint across restarts
+func LoadOrCreateIdentity(path string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(path)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse identity key %s: %w", path, err)
+		}
+		return signer, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unable to read identity key %s: %w", path, err)
+	}
+
+	return createIdentity(path)
+}
+
+func createIdentity(path string) (ssh.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate ed25519 key: %w", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode ed25519 key: %w", err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create directory for identity key %s: %w", path, err)
+	}
+	// O_EXCL so a key written by another process in the meantime is never clobbered
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create identity key %s: %w", path, err)
+	}
+	_, err = f.Write(pemBytes)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to save identity key %s: %w", path, err)
+	}
+
+	return ssh.NewSignerFromKey(priv)
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key in the format used by
+// ssh-keygen and ssh-chat's /whois
+func Fingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityIsReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	first, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(first.PublicKey()) != Fingerprint(second.PublicKey()) {
+		t.Fatal("identity changed between loads")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("identity saved with mode %v", info.Mode().Perm())
+	}
+}
+
+func TestIdentityOnlyCreatedWithoutUserKey(t *testing.T) {
+	home := t.TempDir()
+	oldHome, hadHome := os.LookupEnv("HOME")
+	os.Setenv("HOME", home)
+	t.Cleanup(func() {
+		if hadHome {
+			os.Setenv("HOME", oldHome)
+		} else {
+			os.Unsetenv("HOME")
+		}
+	})
+	userKey := filepath.Join(home, ".ssh", "id_rsa")
+	user, err := LoadOrCreateIdentity(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := startTestServer(t)
+	identity := filepath.Join(t.TempDir(), identityFileName)
+	opts := []Option{WithKnownHosts(filepath.Join(home, "known_hosts")), WithIdentityFile(identity)}
+
+	c, err := CreateClient(server.Addr(), "tester", opts...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	c.Close()
+	if c.Fingerprint() != Fingerprint(user.PublicKey()) {
+		t.Fatalf("authenticated with %s instead of the user's key", c.Fingerprint())
+	}
+	if _, err := os.Stat(identity); !os.IsNotExist(err) {
+		t.Fatal("identity was generated although the user's key works:", err)
+	}
+
+	if err := os.Remove(userKey); err != nil {
+		t.Fatal(err)
+	}
+	c, err = CreateClient(server.Addr(), "tester", opts...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	c.Close()
+	if _, err := os.Stat(identity); err != nil {
+		t.Fatal("identity was not generated when the user has no key:", err)
+	}
+}
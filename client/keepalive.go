@@ -0,0 +1,69 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const keepaliveRequest = "keepalive@openssh.com"
+
+// ErrConnectionDead is returned by reads once the server has stopped
+// answering keepalives for longer than the idle timeout
+var ErrConnectionDead = errors.New("connection is dead, server stopped responding")
+
+// touch records that the server showed a sign of life
+func (c *Client) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *Client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+// keepalive sends a request every interval. A quiet room still answers
+// keepalives, so a connection is only declared dead when neither lines nor
+// replies arrived within idleTimeout.
+func (c *Client) keepalive(interval, idleTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		if c.idleFor() > idleTimeout {
+			c.fail(ErrConnectionDead)
+			return
+		}
+
+		// a reply on a dead link never comes, don't let it block the ticker
+		go func() {
+			// any reply, even a refusal, proves the server is alive
+			if _, _, err := c.client.SendRequest(keepaliveRequest, true, nil); err == nil {
+				c.touch()
+			}
+		}()
+	}
+}
+
+// fail records why the connection is being torn down and closes it so
+// pending reads return
+func (c *Client) fail(err error) {
+	c.failMu.Lock()
+	if c.failure == nil {
+		c.failure = err
+	}
+	c.failMu.Unlock()
+	c.Close()
+}
+
+func (c *Client) failureErr() error {
+	c.failMu.Lock()
+	defer c.failMu.Unlock()
+	return c.failure
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallingProxy forwards connections to a server until stall is called,
+// then swallows everything in both directions while keeping the
+// connections open, like a link that went silent
+type stallingProxy struct {
+	listener net.Listener
+	target   string
+	stalled  chan struct{}
+	once     sync.Once
+}
+
+func startStallingProxy(t *testing.T, target string) *stallingProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &stallingProxy{listener: listener, target: target, stalled: make(chan struct{})}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			t.Cleanup(func() {
+				conn.Close()
+				upstream.Close()
+			})
+			go p.forward(upstream, conn)
+			go p.forward(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func (p *stallingProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *stallingProxy) stall() {
+	p.once.Do(func() { close(p.stalled) })
+}
+
+func (p *stallingProxy) forward(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case <-p.stalled:
+			continue
+		default:
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func TestKeepaliveDetectsSilentServer(t *testing.T) {
+	server := startTestServer(t)
+	proxy := startStallingProxy(t, server.Addr())
+
+	const idleTimeout = 300 * time.Millisecond
+	c, err := CreateClient(proxy.Addr(), "tester", testOptions(t, WithKeepalive(50*time.Millisecond, idleTimeout))...)
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	read := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.ScanLine(); err != nil {
+				read <- err
+				return
+			}
+		}
+	}()
+
+	// a quiet room still answers keepalives
+	select {
+	case err := <-read:
+		t.Fatal("live connection was reported dead:", err)
+	case <-time.After(3 * idleTimeout):
+	}
+
+	proxy.stall()
+	start := time.Now()
+	select {
+	case err := <-read:
+		if !errors.Is(err, ErrConnectionDead) {
+			t.Fatal("expected ErrConnectionDead, got:", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*idleTimeout {
+			t.Fatalf("dead connection noticed after %s", elapsed)
+		}
+	case <-ctx.Done():
+		t.Fatal("ScanLine kept blocking on a silent server")
+	}
+}
+
+func TestKeepaliveIdleTimeout(t *testing.T) {
+	o := defaultOptions()
+	WithKeepalive(time.Second, 0)(o)
+	if o.idleTimeout != 3*time.Second {
+		t.Fatalf("a zero idle timeout became %s", o.idleTimeout)
+	}
+
+	server := startTestServer(t)
+	_, err := CreateClient(server.Addr(), "tester", testOptions(t, WithKeepalive(time.Second, time.Second))...)
+	if err == nil || !strings.Contains(err.Error(), "has to be longer than the keepalive interval") {
+		t.Fatal("expected an idle timeout within one interval to be rejected, got:", err)
+	}
+}
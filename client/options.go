@@ -0,0 +1,84 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option changes how CreateClient connects to the server
+type Option func(*options)
+
+type options struct {
+	knownHostsPath string
+	hostKeyMode    HostKeyMode
+	identityPath   string
+	auth           []SignerSource
+
+	keepaliveInterval time.Duration
+	idleTimeout       time.Duration
+}
+
+func defaultOptions() *options {
+	return &options{
+		knownHostsPath: defaultKnownHostsPath(),
+		hostKeyMode:    HostKeyTOFU,
+		identityPath:   defaultIdentityPath(),
+
+		keepaliveInterval: 30 * time.Second,
+		idleTimeout:       90 * time.Second,
+	}
+}
+
+// WithKnownHosts sets the known_hosts file used to verify the server, it
+// defaults to ~/.ssh/known_hosts
+func WithKnownHosts(path string) Option {
+	return func(o *options) {
+		o.knownHostsPath = path
+	}
+}
+
+// WithHostKeyMode sets how unknown or changed host keys are treated
+func WithHostKeyMode(mode HostKeyMode) Option {
+	return func(o *options) {
+		o.hostKeyMode = mode
+	}
+}
+
+// WithIdentityFile sets where the bot's own key is kept when none of the
+// user's keys in ~/.ssh can be used, the key is generated on first use
+func WithIdentityFile(path string) Option {
+	return func(o *options) {
+		o.identityPath = path
+	}
+}
+
+// WithAuth replaces the default keys with the given sources, they are tried
+// in order and sources that fail to produce a key are skipped
+func WithAuth(sources ...SignerSource) Option {
+	return func(o *options) {
+		o.auth = sources
+	}
+}
+
+// WithKeepalive sends a keepalive every interval and declares the connection
+// dead when the server showed no sign of life for idleTimeout. A zero
+// interval disables keepalives, a zero idleTimeout means three intervals.
+// CreateClient fails when idleTimeout isn't longer than interval, the
+// connection would be torn down before a reply had a chance to arrive.
+func WithKeepalive(interval, idleTimeout time.Duration) Option {
+	return func(o *options) {
+		if idleTimeout <= 0 {
+			idleTimeout = 3 * interval
+		}
+		o.keepaliveInterval = interval
+		o.idleTimeout = idleTimeout
+	}
+}
+
+// validate reports options that can't work together
+func (o *options) validate() error {
+	if o.keepaliveInterval > 0 && o.idleTimeout <= o.keepaliveInterval {
+		return fmt.Errorf("idle timeout %s has to be longer than the keepalive interval %s", o.idleTimeout, o.keepaliveInterval)
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority orders queued lines, higher priorities are written first
+type Priority int
+
+const (
+	// PriorityBulk is for notifications and other lines nobody is waiting on
+	PriorityBulk Priority = iota
+	// PriorityNormal is the default priority
+	PriorityNormal
+	// PriorityReply is for replies to commands a user just sent
+	PriorityReply
+
+	numPriorities = int(PriorityReply) + 1
+)
+
+// ssh-chat allows 3 lines in a 3 second window that starts with the first
+// line, a bucket of 2 refilled every 1.6s never hits the window's limit
+const (
+	bucketCapacity = 2
+	bucketRefill   = 1600 * time.Millisecond
+
+	rejectionBackoff = 3 * time.Second
+	maxSendAttempts  = 5
+	ackTimeout       = 10 * time.Second
+)
+
+// rateLimitRejection is the system message ssh-chat sends instead of
+// relaying a line when the sender is over its rate limit
+const rateLimitRejection = "Message rejected: Rate limiting is in effect."
+
+// errorPrefix starts the system message ssh-chat sends instead of running a
+// command it can't, like a /msg to a user who isn't connected
+const errorPrefix = "Err: "
+
+type outgoingLine struct {
+	line      string
+	recipient string
+	priority  Priority
+	attempts  int
+	// seq orders the lines by when they were last written
+	seq uint64
+
+	delivery *Delivery
+	timeout  *time.Timer
+}
+
+func newOutgoingLine(line string, priority Priority) *outgoingLine {
+	return &outgoingLine{
+		line:      line,
+		recipient: lineRecipient(line),
+		priority:  clampPriority(priority),
+		delivery:  newDelivery(),
+	}
+}
+
+// lineRecipient returns who a "/msg <user> ..." line is for, room lines have no recipient
+func lineRecipient(line string) string {
+	if !strings.HasPrefix(line, "/msg ") {
+		return ""
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+func clampPriority(p Priority) Priority {
+	if p < PriorityBulk {
+		return PriorityBulk
+	}
+	if int(p) >= numPriorities {
+		return PriorityReply
+	}
+	return p
+}
+
+// lane holds the lines of one priority, recipients take turns so a long
+// help text for one user doesn't hold back everyone else
+type lane struct {
+	order []string
+	lines map[string][]*outgoingLine
+}
+
+func (l *lane) push(item *outgoingLine, front bool) {
+	queued, ok := l.lines[item.recipient]
+	if !ok {
+		if front {
+			l.order = append([]string{item.recipient}, l.order...)
+		} else {
+			l.order = append(l.order, item.recipient)
+		}
+	}
+	if front {
+		queued = append([]*outgoingLine{item}, queued...)
+	} else {
+		queued = append(queued, item)
+	}
+	l.lines[item.recipient] = queued
+}
+
+func (l *lane) pop() *outgoingLine {
+	if len(l.order) == 0 {
+		return nil
+	}
+	recipient := l.order[0]
+	queued := l.lines[recipient]
+	item := queued[0]
+
+	l.order = l.order[1:]
+	if len(queued) == 1 {
+		delete(l.lines, recipient)
+	} else {
+		l.lines[recipient] = queued[1:]
+		l.order = append(l.order, recipient)
+	}
+	return item
+}
+
+// sendQueue orders outgoing lines and remembers the ones ssh-chat hasn't
+// confirmed yet so a rejected line can be sent again. Commands ssh-chat
+// doesn't echo are remembered by seq until a later line is answered, ssh-chat
+// answers lines in order so until then a rejection may be about them.
+type sendQueue struct {
+	mu          sync.Mutex
+	lanes       [numPriorities]lane
+	unconfirmed []*outgoingLine
+	commands    []uint64
+	seq         uint64
+
+	// ready has a value whenever lines may be waiting
+	ready chan struct{}
+}
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{ready: make(chan struct{}, 1)}
+	for i := range q.lanes {
+		q.lanes[i].lines = map[string][]*outgoingLine{}
+	}
+	return q
+}
+
+func (q *sendQueue) push(item *outgoingLine) {
+	q.mu.Lock()
+	q.lanes[item.priority].push(item, false)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *sendQueue) pushFront(item *outgoingLine) {
+	q.mu.Lock()
+	q.lanes[item.priority].push(item, true)
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) tryPop() *outgoingLine {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := numPriorities - 1; p >= 0; p-- {
+		if item := q.lanes[p].pop(); item != nil {
+			return item
+		}
+	}
+	return nil
+}
+
+// pop blocks until a line is queued or ctx is done
+func (q *sendQueue) pop(ctx context.Context) (*outgoingLine, error) {
+	for {
+		if item := q.tryPop(); item != nil {
+			return item, nil
+		}
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sending records a line about to be written as waiting for ssh-chat's
+// answer, it has to happen first as the answer can be read before the write
+// returns
+func (q *sendQueue) sending(item *outgoingLine) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item.attempts++
+	q.seq++
+	item.seq = q.seq
+	if !expectsAck(item.line) {
+		q.commands = append(q.commands, item.seq)
+		return
+	}
+
+	q.unconfirmed = append(q.unconfirmed, item)
+	item.timeout = time.AfterFunc(ackTimeout, func() {
+		if q.remove(item) {
+			item.delivery.resolve(ErrAckTimeout)
+		}
+	})
+}
+
+// sent resolves a written line ssh-chat won't echo
+func (q *sendQueue) sent(item *outgoingLine) {
+	if !expectsAck(item.line) {
+		item.delivery.resolve(nil)
+	}
+}
+
+// unsent forgets a line whose write failed
+func (q *sendQueue) unsent(item *outgoingLine) {
+	if item.timeout != nil {
+		item.timeout.Stop()
+	}
+	q.remove(item)
+}
+
+func (q *sendQueue) remove(item *outgoingLine) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, it := range q.unconfirmed {
+		if it == item {
+			q.unconfirmed = append(q.unconfirmed[:i], q.unconfirmed[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// answered forgets the commands written before seq, ssh-chat answered a
+// later line so it is done with them
+func (q *sendQueue) answered(seq uint64) {
+	for len(q.commands) > 0 && q.commands[0] < seq {
+		q.commands = q.commands[1:]
+	}
+}
+
+// confirm resolves the oldest unconfirmed line matching the check
+func (q *sendQueue) confirm(matches func(item *outgoingLine) bool) *outgoingLine {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.unconfirmed {
+		if matches(item) {
+			q.unconfirmed = append(q.unconfirmed[:i], q.unconfirmed[i+1:]...)
+			q.answered(item.seq)
+			item.timeout.Stop()
+			item.delivery.resolve(nil)
+			return item
+		}
+	}
+	return nil
+}
+
+// rejected takes the oldest unconfirmed line, ssh-chat handles lines in
+// order so that is the one the rejection is about. It returns nil when a
+// command written before that line may still be waiting for its answer,
+// the rejection is taken to be about the command which is then forgotten.
+func (q *sendQueue) rejected() *outgoingLine {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.unconfirmed) == 0 || len(q.commands) > 0 && q.commands[0] < q.unconfirmed[0].seq {
+		if len(q.commands) > 0 {
+			q.commands = q.commands[1:]
+		}
+		return nil
+	}
+	item := q.unconfirmed[0]
+	q.unconfirmed = q.unconfirmed[1:]
+	q.answered(item.seq)
+	item.timeout.Stop()
+	return item
+}
+
+// fail resolves every queued and unconfirmed line with err
+func (q *sendQueue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.lanes {
+		for item := q.lanes[i].pop(); item != nil; item = q.lanes[i].pop() {
+			item.delivery.resolve(err)
+		}
+	}
+	for _, item := range q.unconfirmed {
+		item.timeout.Stop()
+		item.delivery.resolve(err)
+	}
+	q.unconfirmed = nil
+	q.commands = nil
+}
+
+// tokenBucket paces writes below ssh-chat's rate limit
+type tokenBucket struct {
+	mu          sync.Mutex
+	capacity    float64
+	refill      time.Duration
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newTokenBucket(capacity int, refill time.Duration) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(capacity),
+		refill:   refill,
+		tokens:   float64(capacity),
+		last:     time.Now(),
+	}
+}
+
+// take uses a token when one is available, otherwise it returns how long
+// until the next one
+func (b *tokenBucket) take() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(b.refill)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(b.refill))
+}
+
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		delay := b.take()
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// pause empties the bucket and stops handing out tokens for d
+func (b *tokenBucket) pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = 0
+	b.last = time.Now().Add(d)
+	b.pausedUntil = b.last
+}
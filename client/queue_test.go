@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func popAll(q *sendQueue) []string {
+	var lines []string
+	for item := q.tryPop(); item != nil; item = q.tryPop() {
+		lines = append(lines, item.line)
+	}
+	return lines
+}
+
+func expectLines(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestQueuePopsByPriorityThenRecipient(t *testing.T) {
+	q := newSendQueue()
+	for _, queued := range []struct {
+		line     string
+		priority Priority
+	}{
+		{"/msg alice bulk", PriorityBulk},
+		{"room one", PriorityNormal},
+		{"/msg bob one", PriorityReply},
+		{"/msg bob two", PriorityReply},
+		{"/msg bob three", PriorityReply},
+		{"/msg carol one", PriorityReply},
+		{"room two", PriorityNormal},
+		{"/msg dave out of range", Priority(42)},
+	} {
+		q.push(newOutgoingLine(queued.line, queued.priority))
+	}
+
+	expectLines(t, popAll(q), []string{
+		// bob's long reply doesn't hold back carol and dave
+		"/msg bob one", "/msg carol one", "/msg dave out of range", "/msg bob two", "/msg bob three",
+		"room one", "room two",
+		"/msg alice bulk",
+	})
+}
+
+func TestQueuePushFrontGoesFirstForItsRecipient(t *testing.T) {
+	q := newSendQueue()
+	q.push(newOutgoingLine("/msg bob one", PriorityNormal))
+	q.push(newOutgoingLine("/msg carol one", PriorityNormal))
+	q.push(newOutgoingLine("/msg bob reply", PriorityReply))
+	q.pushFront(newOutgoingLine("/msg carol retry", PriorityNormal))
+	q.pushFront(newOutgoingLine("/msg dave retry", PriorityNormal))
+
+	expectLines(t, popAll(q), []string{"/msg bob reply", "/msg dave retry", "/msg bob one", "/msg carol retry", "/msg carol one"})
+}
+
+func TestQueuePopWaitsForLines(t *testing.T) {
+	q := newSendQueue()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.push(newOutgoingLine("late", PriorityNormal))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	item, err := q.pop(ctx)
+	if err != nil || item.line != "late" {
+		t.Fatalf("unexpected pop: %v %v", item, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.pop(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected pop on an empty queue to wait for ctx, got:", err)
+	}
+}
+
+func TestTokenBucketPacesWrites(t *testing.T) {
+	const refill = 50 * time.Millisecond
+	b := newTokenBucket(2, refill)
+
+	for i := 0; i < 2; i++ {
+		if delay := b.take(); delay != 0 {
+			t.Fatalf("token %d of a full bucket waited %s", i, delay)
+		}
+	}
+	if delay := b.take(); delay <= 0 || delay > refill {
+		t.Fatalf("empty bucket asked to wait %s", delay)
+	}
+
+	start := time.Now()
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < refill*8/10 {
+		t.Fatalf("empty bucket handed out a token after %s", elapsed)
+	}
+}
+
+func TestTokenBucketRefillIsCapped(t *testing.T) {
+	const refill = 10 * time.Millisecond
+	b := newTokenBucket(2, refill)
+	b.take()
+	b.take()
+
+	time.Sleep(10 * refill)
+	for i := 0; i < 2; i++ {
+		if delay := b.take(); delay != 0 {
+			t.Fatalf("refilled token %d waited %s", i, delay)
+		}
+	}
+	if delay := b.take(); delay == 0 {
+		t.Fatal("bucket refilled beyond its capacity")
+	}
+}
+
+func TestTokenBucketPause(t *testing.T) {
+	const pause = 100 * time.Millisecond
+	b := newTokenBucket(2, time.Millisecond)
+	b.pause(pause)
+
+	if delay := b.take(); delay <= 0 || delay > pause {
+		t.Fatalf("paused bucket asked to wait %s", delay)
+	}
+	start := time.Now()
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < pause*8/10 {
+		t.Fatalf("paused bucket handed out a token after %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.pause(time.Minute)
+	if err := b.wait(ctx); err != context.Canceled {
+		t.Fatal("expected wait to give up with ctx, got:", err)
+	}
+}
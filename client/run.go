@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+// ErrClosed is returned when sending on a client that has been closed
+var ErrClosed = errors.New("client is closed")
+
+// Event is a line read from ssh-chat, Msg is nil when the line could not be parsed
+type Event struct {
+	Line string
+	Msg  parser.RoomMsg
+}
+
+// Run reads lines from the server and sends them on events while writing
+// the lines queued with Send. It returns when ctx is cancelled or the
+// connection fails, the client is closed and events is closed before it returns.
+func (c *Client) Run(ctx context.Context, events chan<- Event) error {
+	defer close(events)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, 2)
+	go func() { errs <- c.readLoop(runCtx, events) }()
+	go func() { errs <- c.writeLoop(runCtx) }()
+
+	var err error
+	pending := 2
+	select {
+	case err = <-errs:
+		pending--
+	case <-ctx.Done():
+	}
+
+	// closing the session is the only way to unblock a pending read
+	cancel()
+	c.Close()
+	for ; pending > 0; pending-- {
+		<-errs
+	}
+	c.queue.fail(ErrClosed)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Send queues a line with normal priority to be written by Run
+func (c *Client) Send(ctx context.Context, line string) (*Delivery, error) {
+	return c.SendPriority(ctx, line, PriorityNormal)
+}
+
+// SendPriority queues a line to be written by Run, lines with a higher
+// priority are written first and lines of the same priority take turns by
+// recipient. The returned delivery resolves once ssh-chat echoed the line.
+func (c *Client) SendPriority(ctx context.Context, line string, priority Priority) (*Delivery, error) {
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	item := newOutgoingLine(line, priority)
+	c.queue.push(item)
+	return item.delivery, nil
+}
+
+func (c *Client) readLoop(ctx context.Context, events chan<- Event) error {
+	lineParser := parser.New()
+	for {
+		line, err := c.ScanLine()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "read failed")
+		}
+
+		msg, _ := lineParser.Parse([]byte(line))
+		c.observe(msg)
+		select {
+		case events <- Event{Line: line, Msg: msg}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) writeLoop(ctx context.Context) error {
+	for {
+		item, err := c.queue.pop(ctx)
+		if err != nil {
+			return err
+		}
+		if err := c.bucket.wait(ctx); err != nil {
+			return err
+		}
+		c.queue.sending(item)
+		if err := c.writeLine(item.line); err != nil {
+			c.queue.unsent(item)
+			item.delivery.resolve(err)
+			return err
+		}
+		c.queue.sent(item)
+	}
+}
+
+// observe matches ssh-chat's echoes and rejections with the lines written
+func (c *Client) observe(msg parser.RoomMsg) {
+	switch m := msg.(type) {
+	case parser.AckMsg:
+		c.queue.confirm(func(item *outgoingLine) bool {
+			return ackMatches(m, item)
+		})
+
+	case parser.SystemMsg:
+		if strings.HasPrefix(m.Message, errorPrefix) {
+			if item := c.queue.rejected(); item != nil {
+				item.delivery.resolve(fmt.Errorf("%w: %s", ErrRejected, strings.TrimPrefix(m.Message, errorPrefix)))
+			}
+			return
+		}
+		if m.Message != rateLimitRejection {
+			return
+		}
+		item := c.queue.rejected()
+		if item == nil {
+			c.bucket.pause(rejectionBackoff)
+			return
+		}
+		c.bucket.pause(time.Duration(item.attempts) * rejectionBackoff)
+		if item.attempts >= maxSendAttempts {
+			item.delivery.resolve(ErrRateLimited)
+			return
+		}
+		c.queue.pushFront(item)
+	}
+}
+
+func ackMatches(ack parser.AckMsg, item *outgoingLine) bool {
+	switch ack.Type {
+	case parser.AckMsgPrivate:
+		return item.recipient == ack.Username
+	case parser.AckMsgPublic:
+		return item.recipient == "" && strings.TrimSpace(item.line) == strings.TrimSpace(ack.Message)
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testGreeting is the line the test server writes when a session starts
+const testGreeting = "welcome"
+
+// testServer is a bare ssh server for tests that need to pick the host keys
+// or cut the connection. It lets every key in, greets each session with a
+// line and discards whatever the client writes.
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestServer(t *testing.T, hostKeys ...ssh.Signer) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		listener: listener,
+		config: &ssh.ServerConfig{
+			PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+				return nil, nil
+			},
+		},
+	}
+	if len(hostKeys) == 0 {
+		hostKeys = []ssh.Signer{newTestKey(t)}
+	}
+	for _, key := range hostKeys {
+		s.config.AddHostKey(key)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+		s.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// drop cuts every connection without a goodbye
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) serve(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, netConn)
+	s.mu.Unlock()
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range chReqs {
+				req.Reply(req.Type == "pty-req" || req.Type == "shell", nil)
+				if req.Type == "shell" {
+					io.WriteString(ch, testGreeting+"\r\n")
+				}
+			}
+		}()
+		go io.Copy(ioutil.Discard, ch)
+	}
+}
+
+func newTestKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testOptions keeps everything a client writes inside the test's temp dir
+func testOptions(t *testing.T, extra ...Option) []Option {
+	dir := t.TempDir()
+	opts := []Option{
+		WithKnownHosts(filepath.Join(dir, "known_hosts")),
+		WithAuth(Identity(filepath.Join(dir, "id_ed25519"))),
+		WithKeepalive(0, 0),
+	}
+	return append(opts, extra...)
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Backoff computes how long to wait between reconnect attempts
+type Backoff struct {
+	// Initial is the delay after the first failure
+	Initial time.Duration
+	// Max caps the delay
+	Max time.Duration
+	// Factor multiplies the delay after every failed attempt
+	Factor float64
+	// Jitter randomizes the delay by up to this fraction in either direction
+	Jitter float64
+}
+
+// DefaultBackoff starts retrying after a second and waits at most five minutes
+func DefaultBackoff() Backoff {
+	return Backoff{
+		Initial: time.Second,
+		Max:     5 * time.Minute,
+		Factor:  2,
+		Jitter:  0.2,
+	}
+}
+
+// Delay returns the wait before the given attempt, attempts are counted from zero
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 0; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Factor
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Supervisor keeps a client connected to ssh-chat, reconnecting with
+// backoff whenever the connection fails or drops
+type Supervisor struct {
+	destination string
+	username    string
+	opts        []Option
+
+	// Backoff controls the wait between attempts
+	Backoff Backoff
+	// OnConnect is called with every newly connected client
+	OnConnect func(c *Client)
+	// OnDisconnect is called with the error that ended a session or failed a
+	// connection attempt and how long the supervisor waits before retrying
+	OnDisconnect func(err error, retryIn time.Duration)
+}
+
+// NewSupervisor creates a supervisor connecting to destination as username
+func NewSupervisor(destination, username string, opts ...Option) *Supervisor {
+	return &Supervisor{
+		destination: destination,
+		username:    username,
+		opts:        opts,
+		Backoff:     DefaultBackoff(),
+	}
+}
+
+// Run connects and calls handle with each new client, handle should return
+// when the client fails. Run only returns when ctx is cancelled or the
+// server can't be trusted, a session that read at least one line resets the
+// backoff.
+func (s *Supervisor) Run(ctx context.Context, handle func(ctx context.Context, c *Client) error) error {
+	attempt := 0
+	for {
+		err := s.session(ctx, handle, &attempt)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isPermanent(err) {
+			return err
+		}
+
+		delay := s.Backoff.Delay(attempt)
+		attempt++
+		if s.OnDisconnect != nil {
+			s.OnDisconnect(err, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Supervisor) session(ctx context.Context, handle func(ctx context.Context, c *Client) error, attempt *int) error {
+	c, err := CreateClient(s.destination, s.username, s.opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if s.OnConnect != nil {
+		s.OnConnect(c)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	err = handle(ctx, c)
+	if c.LinesRead() > 0 {
+		*attempt = 0
+	}
+	if err == nil {
+		err = errors.New("session ended")
+	}
+	return err
+}
+
+// isPermanent reports errors that reconnecting won't fix
+func isPermanent(err error) bool {
+	var mismatch *HostKeyMismatchError
+	var unknown *UnknownHostError
+	return errors.As(err, &mismatch) || errors.As(err, &unknown)
+}
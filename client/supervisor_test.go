@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestBackoffDelayGrowsToMax(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Factor: 2}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for attempt, w := range want {
+		if got := b.Delay(attempt); got != w {
+			t.Errorf("attempt %d: expected %s, got %s", attempt, w, got)
+		}
+	}
+	if got := b.Delay(10000); got != b.Max {
+		t.Errorf("a long outage waits %s instead of the max", got)
+	}
+}
+
+func TestBackoffJitterStaysInBounds(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 8 * time.Second, Factor: 2, Jitter: 0.25}
+	for _, attempt := range []int{0, 2, 50} {
+		base := Backoff{Initial: b.Initial, Max: b.Max, Factor: b.Factor}.Delay(attempt)
+		low, high := base*3/4, base*5/4
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 1000; i++ {
+			d := b.Delay(attempt)
+			if d < low || d > high {
+				t.Fatalf("attempt %d: %s is outside [%s, %s]", attempt, d, low, high)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("attempt %d: jitter never changed the delay", attempt)
+		}
+	}
+}
+
+func TestSupervisorReconnectsWithBackoff(t *testing.T) {
+	server := startTestServer(t)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	s := NewSupervisor(server.Addr(), "tester", testOptions(t, WithKnownHosts(knownHosts))...)
+	s.Backoff = Backoff{Initial: 20 * time.Millisecond, Max: 80 * time.Millisecond, Factor: 2}
+	var delays []time.Duration
+	s.OnDisconnect = func(err error, retryIn time.Duration) {
+		delays = append(delays, retryIn)
+	}
+
+	sessions := 0
+	err := s.Run(ctx, func(ctx context.Context, c *Client) error {
+		sessions++
+		// the fourth session reads the greeting before it drops
+		if sessions == 4 {
+			if _, err := c.ScanLine(); err != nil {
+				return err
+			}
+		}
+		server.drop()
+		if sessions == 5 {
+			// the server now presents a different key
+			line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr())}, newTestKey(t).PublicKey())
+			if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+				return err
+			}
+		}
+		return errors.New("connection dropped")
+	})
+
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatal("expected the supervisor to give up on a changed host key, got:", err)
+	}
+	if sessions != 5 {
+		t.Fatalf("expected 5 sessions, got %d", sessions)
+	}
+	want := []time.Duration{
+		20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond,
+		// the fourth session read a line
+		20 * time.Millisecond, 40 * time.Millisecond,
+	}
+	if len(delays) != len(want) {
+		t.Fatalf("expected delays %v, got %v", want, delays)
+	}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Fatalf("expected delays %v, got %v", want, delays)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// chatlog reads the room archive notifyi writes
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/voldyman/ssh-chat-notify/archive"
+)
+
+const timeLayout = "2006-01-02 15:04:05"
+
+type globalOptions struct {
+	ArchiveDir string `short:"a" long:"archive" description:"archive directory written by notifyi" default:"archive"`
+}
+
+var global globalOptions
+
+type searchCommand struct {
+	Context int `short:"C" long:"context" description:"lines to show around each match" default:"2"`
+	Limit   int `short:"n" long:"limit" description:"most matches to show, newest first" default:"20"`
+
+	Args struct {
+		Terms []string `positional-arg-name:"terms" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *searchCommand) Execute(args []string) error {
+	a, err := archive.OpenReadOnly(global.ArchiveDir)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	query := archive.Query{Terms: c.Args.Terms, Context: c.Context, Limit: c.Limit, Kinds: archive.PublicKinds}
+	results, err := a.Search(query)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("nothing matches '%s'", strings.Join(c.Args.Terms, " "))
+	}
+
+	for i, r := range results {
+		if i > 0 {
+			fmt.Println("--")
+		}
+		for _, e := range r.Before {
+			printEntry(e, " ")
+		}
+		printEntry(r.Match, ">")
+		for _, e := range r.After {
+			printEntry(e, " ")
+		}
+	}
+	return nil
+}
+
+type exportCommand struct {
+	Format   string `short:"f" long:"format" description:"jsonl, irssi or html" default:"irssi"`
+	From     string `long:"from" description:"first moment to export, like 2006-01-02 or 2006-01-02 15:04"`
+	To       string `long:"to" description:"moment to stop before, same formats as --from"`
+	Output   string `short:"o" long:"output" description:"file to write, standard output when empty"`
+	Title    string `long:"title" description:"heading of the html page"`
+	Timezone string `short:"z" long:"tz" description:"timezone times are shown in, local time when empty"`
+}
+
+func (c *exportCommand) Execute(args []string) error {
+	known := false
+	for _, f := range archive.Formats {
+		known = known || f == c.Format
+	}
+	if !known {
+		return fmt.Errorf("unknown format '%s', use one of %s", c.Format, strings.Join(archive.Formats, ", "))
+	}
+
+	loc := time.Local
+	if c.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return err
+		}
+	}
+	from, err := parseTime(c.From, loc)
+	if err != nil {
+		return err
+	}
+	to, err := parseTime(c.To, loc)
+	if err != nil {
+		return err
+	}
+
+	a, err := archive.OpenReadOnly(global.ArchiveDir)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	out := os.Stdout
+	if c.Output != "" {
+		if out, err = os.Create(c.Output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	exp, err := archive.NewExporter(c.Format, out, archive.ExportOptions{Location: loc, Title: c.Title})
+	if err != nil {
+		return err
+	}
+	return a.Export(exp, from, to, archive.PublicKinds)
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseTime reads a --from or --to value in loc, empty is the zero time
+func parseTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to read '%s' as a time, use 2006-01-02 15:04", s)
+}
+
+func printEntry(e archive.Entry, marker string) {
+	fmt.Printf("%s %s %s\n", e.Time.Local().Format(timeLayout), marker, strings.TrimSpace(e.String()))
+}
+
+func main() {
+	parser := flags.NewParser(&global, flags.Default)
+	parser.AddCommand("search", "Search the archive",
+		"Prints the newest archived lines containing every term, with the lines around them.",
+		&searchCommand{})
+	parser.AddCommand("export", "Export a transcript",
+		"Writes the archived lines in a time range as JSON Lines, an irssi style log or a standalone HTML page.",
+		&exportCommand{})
+
+	// the parser prints errors itself, commands included
+	if _, err := parser.Parse(); err != nil && !flags.WroteHelp(err) {
+		os.Exit(1)
+	}
+}
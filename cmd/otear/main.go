@@ -3,10 +3,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net/http"
-	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	config "github.com/gookit/config/v2"
@@ -15,25 +17,94 @@ import (
 	"github.com/pkg/errors"
 	lg "github.com/sirupsen/logrus"
 	sshclient "github.com/voldyman/ssh-chat-notify/client"
+	"github.com/voldyman/ssh-chat-notify/notifier"
 )
 
+const defaultDeadLetterFile = "otear-dead-letters.jsonl"
+
+const eventBufferSize = 256
+
+// drainTimeout is how long queued notifications get to go out on shutdown
+const drainTimeout = 30 * time.Second
+
 func main() {
 	if err := run(); err != nil {
+		if flags.WroteHelp(err) {
+			return
+		}
 		panic(err)
 	}
 }
 
-type MentionConfig struct {
-	Name             string   `mapstructure:"name"`
-	Keywords         []string `mapstructure:"keywords"`
-	PushoverToken    string   `mapstructure:"pushover-token"`
-	PushoverGroupKey string   `mapstructure:"pushover-group"`
+type AuthConfig struct {
+	Methods        []string `mapstructure:"methods"`
+	KeyFiles       []string `mapstructure:"key-files"`
+	PassphraseEnv  string   `mapstructure:"passphrase-env"`
+	PassphraseFile string   `mapstructure:"passphrase-file"`
+}
+
+// DeliveryConfig tunes the notification queue, durations use Go's syntax
+// like "10s" and anything left out gets a default
+type DeliveryConfig struct {
+	Workers        int    `mapstructure:"workers"`
+	QueueSize      int    `mapstructure:"queue-size"`
+	Timeout        string `mapstructure:"timeout"`
+	MaxAttempts    int    `mapstructure:"max-attempts"`
+	Backoff        string `mapstructure:"backoff"`
+	MaxBackoff     string `mapstructure:"max-backoff"`
+	DeadLetterFile string `mapstructure:"dead-letter-file"`
+}
+
+func (d DeliveryConfig) retryPolicy() (notifier.RetryPolicy, error) {
+	policy := notifier.RetryPolicy{
+		MaxAttempts: d.MaxAttempts,
+		OnError: func(d notifier.Delivery, err error, retrying bool) {
+			lg.WithFields(lg.Fields{
+				"cfg":      d.Mention,
+				"notifier": d.Type,
+				"attempt":  d.Attempts,
+				"retrying": retrying,
+			}).Warn("Unable to notify: ", err)
+		},
+	}
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"timeout", d.Timeout, &policy.Timeout},
+		{"backoff", d.Backoff, &policy.Backoff},
+		{"max-backoff", d.MaxBackoff, &policy.MaxBackoff},
+	}
+	for _, dur := range durations {
+		if dur.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(dur.value)
+		if err != nil {
+			return policy, errors.Wrapf(err, "invalid delivery %s", dur.name)
+		}
+		*dur.dest = parsed
+	}
+	return policy, nil
+}
+
+func (d DeliveryConfig) deadLetters() *notifier.DeadLetters {
+	if d.DeadLetterFile == "" {
+		return notifier.NewDeadLetters(defaultDeadLetterFile)
+	}
+	return notifier.NewDeadLetters(d.DeadLetterFile)
 }
 
 type Config struct {
 	ServerAddr  string          `mapstructure:"server-addr"`
 	BotName     string          `mapstructure:"name"`
+	KnownHosts  string          `mapstructure:"known-hosts"`
+	HostKeyMode string          `mapstructure:"host-key-mode"`
+	Identity    string          `mapstructure:"identity-file"`
+	Auth        AuthConfig      `mapstructure:"auth"`
 	MentionCfgs []MentionConfig `mapstructure:"mentions"`
+	Delivery    DeliveryConfig  `mapstructure:"delivery"`
 }
 
 type CliOptions struct {
@@ -42,12 +113,24 @@ type CliOptions struct {
 	LogTimeLocation string `short:"z" long:"log-tz" description:"timezone for log messages" default:"America/Vancouver"`
 }
 
+// ReplayCommand retries the notifications that ran out of attempts
+type ReplayCommand struct {
+	List bool `short:"l" long:"list" description:"only list the dead letters"`
+}
+
 func run() error {
 	var opts CliOptions
-	_, err := flags.Parse(&opts)
+	var replay ReplayCommand
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	_, err := parser.AddCommand("replay", "replay dead letters",
+		"Sends the notifications in the dead-letter file again, the ones that still fail stay in it", &replay)
 	if err != nil {
 		return err
 	}
+	if _, err := parser.Parse(); err != nil {
+		return err
+	}
 	err = setupLogger(opts)
 	if err != nil {
 		return err
@@ -56,45 +139,132 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	for {
-		client, err := sshclient.CreateClient(cfg.ServerAddr, cfg.BotName)
-		if err != nil {
-			lg.Warn("connect failed: ", err)
-			time.Sleep(1 * time.Minute)
-			continue
-		}
-		defer func() {
-			if client != nil {
-				client.Close()
-			}
-		}()
-		lg.Info("connection established")
+	policy, err := cfg.Delivery.retryPolicy()
+	if err != nil {
+		return err
+	}
+	mentions, err := newMentions(cfg.MentionCfgs)
+	if err != nil {
+		return err
+	}
+	if parser.Active != nil && parser.Active.Name == "replay" {
+		return replayDeadLetters(cfg.Delivery.deadLetters(), mentions, policy, replay.List)
+	}
 
-		readSomething := false
+	clientOpts, err := clientOptions(cfg)
+	if err != nil {
+		return err
+	}
 
-		err = handle(cfg.MentionCfgs, func() (string, error) {
-			line, err := client.ScanLine()
-			if err == nil {
-				readSomething = true
-			}
-			return line, err
-		})
+	ctx, cancel := signalContext()
+	defer cancel()
 
-		if err == nil {
-			lg.Info("handle returned without error")
-			continue
+	queue := notifier.NewQueue(notifier.QueueConfig{
+		RetryPolicy: policy,
+		Workers:     cfg.Delivery.Workers,
+		Size:        cfg.Delivery.QueueSize,
+		DeadLetters: cfg.Delivery.deadLetters(),
+	})
+	defer func() {
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := queue.Close(drainCtx); err != nil {
+			lg.Warn("Gave up waiting for notifications, the rest were dead-lettered: ", err)
 		}
-		if !readSomething {
-			return errors.Wrapf(err, "failed without reading from server")
+	}()
+
+	supervisor := sshclient.NewSupervisor(cfg.ServerAddr, cfg.BotName, clientOpts...)
+	supervisor.OnConnect = func(c *sshclient.Client) {
+		lg.WithField("fingerprint", c.Fingerprint()).Info("connection established")
+	}
+	supervisor.OnDisconnect = func(err error, retryIn time.Duration) {
+		lg.WithField("retry-in", retryIn).Warn("connection lost, retrying: ", err)
+	}
+
+	err = supervisor.Run(ctx, func(ctx context.Context, c *sshclient.Client) error {
+		events := make(chan sshclient.Event, eventBufferSize)
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- c.Run(ctx, events)
+		}()
+		handle(mentions, queue, cfg.BotName, events)
+		return <-runErr
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
 		}
-		lg.Warn("message handler failed, retrying: ", err)
-		err = client.Close()
+	}()
+	return ctx, cancel
+}
+
+func replayDeadLetters(deadLetters *notifier.DeadLetters, mentions []mention, policy notifier.RetryPolicy, list bool) error {
+	if list {
+		pending, err := deadLetters.Load()
 		if err != nil {
-			lg.Warn("unable close client: ", err)
+			return err
+		}
+		for _, d := range pending {
+			fmt.Printf("%s  %-8s %-12s %s: %s\n    %s\n",
+				d.FailedAt.Format(time.RFC3339), d.Type, d.Mention,
+				d.Notification.From, d.Notification.Message, d.Error)
 		}
-		client = nil
-		time.Sleep(30 * time.Second)
+		fmt.Printf("%d dead letters in %s\n", len(pending), deadLetters.Path())
+		return nil
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	sent, failed, err := deadLetters.Replay(ctx, func(d *notifier.Delivery) error {
+		if err := resolveDelivery(mentions, d); err != nil {
+			d.Error = err.Error()
+			return err
+		}
+		return policy.Deliver(ctx, d)
+	})
+	lg.WithFields(lg.Fields{"sent": sent, "failed": failed}).Info("Replayed dead letters")
+	return err
+}
+
+func clientOptions(cfg *Config) ([]sshclient.Option, error) {
+	mode, err := sshclient.ParseHostKeyMode(cfg.HostKeyMode)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid host-key-mode")
+	}
+	opts := []sshclient.Option{sshclient.WithHostKeyMode(mode)}
+	if cfg.KnownHosts != "" {
+		opts = append(opts, sshclient.WithKnownHosts(cfg.KnownHosts))
+	}
+	if cfg.Identity != "" {
+		opts = append(opts, sshclient.WithIdentityFile(cfg.Identity))
+	}
+
+	sources, err := sshclient.AuthConfig{
+		Methods:        cfg.Auth.Methods,
+		KeyFiles:       cfg.Auth.KeyFiles,
+		PassphraseEnv:  cfg.Auth.PassphraseEnv,
+		PassphraseFile: cfg.Auth.PassphraseFile,
+		IdentityFile:   cfg.Identity,
+	}.Sources()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid auth config")
+	}
+	if len(sources) > 0 {
+		opts = append(opts, sshclient.WithAuth(sources...))
 	}
+	return opts, nil
 }
 
 func loadConfig(file string) (*Config, error) {
@@ -112,86 +282,39 @@ func loadConfig(file string) (*Config, error) {
 	return &cfg, nil
 }
 
-func handle(mentions []MentionConfig, readLine func() (string, error)) error {
-	for {
-		cline, err := readLine()
-		if err != nil {
-			return errors.Wrapf(err, "read failed")
-		}
-		line := strings.TrimSpace(cline)
-
-		lg.WithField("line", line).Debug("Scanned line")
-
-		if len(line) == 0 {
-			continue
-		}
-
-		if strings.HasPrefix(line, "*") {
-			lg.Debug("Ignoring system message")
+func handle(mentions []mention, queue *notifier.Queue, self string, events <-chan sshclient.Event) {
+	for event := range events {
+		lg.WithField("line", event.Line).Debug("Scanned line")
+		if event.Msg == nil {
+			if strings.TrimSpace(event.Line) != "" {
+				lg.WithField("line", event.Line).Warn("Unable to parse line, ignoring")
+			}
 			continue
 		}
 
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			lg.WithField("line", line).
-				Warn("Message does not have a sender, ignoring")
-			continue
-		}
-		from := strings.TrimSpace(parts[0])
-		msg := strings.TrimSpace(parts[1])
-
-		for _, mcfg := range mentions {
-
-			if checkKeyword(msg, mcfg.Keywords) {
-				lg.WithFields(lg.Fields{"from": from, "message": msg, "cfg": mcfg.Name}).
-					Info("Notifying for message")
-				sendPushoverNotification(from, msg, pushoverCfg{
-					Token:    mcfg.PushoverToken,
-					GroupKey: mcfg.PushoverGroupKey,
-				})
+		for _, m := range mentions {
+			n, ok := m.match(event.Msg, self)
+			if !ok {
+				continue
 			}
+			n.Time = time.Now()
+			lg.WithFields(lg.Fields{"from": n.From, "message": n.Message, "cfg": m.Name}).
+				Info("Notifying for message")
+			notify(queue, m, n)
 		}
-
 	}
 }
 
-func checkKeyword(str string, keywords []string) bool {
-	for _, word := range keywords {
-		if strings.Contains(str, word) {
-			lg.WithField("word", word).
-				Info("Found keyword")
-
-			return true
+func notify(queue *notifier.Queue, m mention, n notifier.Notification) {
+	for i, ncfg := range m.notifiers {
+		err := queue.Enqueue(notifier.Delivery{Mention: m.Name, Notifier: i, Type: ncfg.Type, Config: ncfg, Notification: n})
+		if err != nil {
+			lg.WithFields(lg.Fields{"cfg": m.Name, "notifier": ncfg.Type}).
+				Warn("Unable to queue notification: ", err)
 		}
 	}
-	return false
-}
-
-const pushoverMessageURL = "https://api.pushover.net/1/messages.json"
-
-type pushoverCfg struct {
-	Token    string
-	GroupKey string
 }
 
-func sendPushoverNotification(from, message string, po pushoverCfg) {
-	params := url.Values{}
-	params.Add("token", po.Token)
-	params.Add("user", po.GroupKey)
-	params.Add("title", "SSH Chat Mention")
-	params.Add("message", fmt.Sprintf("%s said: %s", from, message))
-
-	resp, err := http.PostForm(pushoverMessageURL, params)
-	if err != nil {
-		lg.Warn("Unable to publish to pushover: ", err)
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		lg.WithField("status", resp.StatusCode).
-			Warn("Unexpected status code from pushover: ", resp)
-		return
-	}
-}
 func setupLogger(opts CliOptions) error {
 	if opts.Verbose {
 		lg.SetLevel(lg.DebugLevel)
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	lg "github.com/sirupsen/logrus"
+	"github.com/voldyman/ssh-chat-notify/match"
+	"github.com/voldyman/ssh-chat-notify/notifier"
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+// MentionConfig is what to look for and who to tell about it. Public
+// messages are always checked, the switches add other kinds of lines.
+type MentionConfig struct {
+	Name string `mapstructure:"name"`
+	// Keywords are case-sensitive literals, Patterns can use the other modes
+	Keywords     []string          `mapstructure:"keywords"`
+	Patterns     []match.Pattern   `mapstructure:"patterns"`
+	Exclude      []match.Pattern   `mapstructure:"exclude"`
+	AllowSenders []string          `mapstructure:"allow-senders"`
+	DenySenders  []string          `mapstructure:"deny-senders"`
+	Notifiers    []notifier.Config `mapstructure:"notifiers"`
+
+	// IgnoreOwnLines skips lines the bot sent itself, it is on unless set to false
+	IgnoreOwnLines *bool `mapstructure:"ignore-own-lines"`
+
+	// Actions checks /me lines
+	Actions bool `mapstructure:"actions"`
+	// PrivateMessages checks PMs sent to the bot
+	PrivateMessages bool `mapstructure:"private-messages"`
+	// Joins checks the names of users joining the room
+	Joins bool `mapstructure:"joins"`
+
+	// PushoverToken and PushoverGroupKey predate notifiers, when set they
+	// add a pushover notifier
+	PushoverToken    string `mapstructure:"pushover-token"`
+	PushoverGroupKey string `mapstructure:"pushover-group"`
+}
+
+// mention is a MentionConfig with its patterns compiled and notifiers checked
+type mention struct {
+	MentionConfig
+	matcher   *match.Matcher
+	ignoreOwn bool
+	notifiers []notifier.Config
+}
+
+// spec turns the keywords and patterns into one matcher spec, keywords come first
+func (mcfg MentionConfig) spec() match.Spec {
+	spec := match.Spec{
+		Exclude:      mcfg.Exclude,
+		AllowSenders: mcfg.AllowSenders,
+		DenySenders:  mcfg.DenySenders,
+	}
+	for _, word := range mcfg.Keywords {
+		spec.Patterns = append(spec.Patterns, match.Pattern{Match: word, Mode: match.ModeLiteral})
+	}
+	spec.Patterns = append(spec.Patterns, mcfg.Patterns...)
+	return spec
+}
+
+// keywordError makes errors in the keywords spec put ahead of the patterns
+// point at the right list
+func keywordError(err error, keywords int) error {
+	var entryErr *match.EntryError
+	if !errors.As(err, &entryErr) || entryErr.Field != "patterns" {
+		return err
+	}
+	if entryErr.Index < keywords {
+		entryErr.Field = "keywords"
+	} else {
+		entryErr.Index -= keywords
+	}
+	return err
+}
+
+func newMentions(cfgs []MentionConfig) ([]mention, error) {
+	mentions := make([]mention, 0, len(cfgs))
+	for i, mcfg := range cfgs {
+		ncfgs := mcfg.Notifiers
+		if mcfg.PushoverToken != "" || mcfg.PushoverGroupKey != "" {
+			ncfgs = append(ncfgs, notifier.Config{
+				Type:  "pushover",
+				Token: mcfg.PushoverToken,
+				User:  mcfg.PushoverGroupKey,
+			})
+		}
+		if len(ncfgs) == 0 {
+			lg.WithField("cfg", mcfg.Name).Warn("Mention has no notifiers, matches will only be logged")
+		}
+
+		m := mention{MentionConfig: mcfg, ignoreOwn: mcfg.IgnoreOwnLines == nil || *mcfg.IgnoreOwnLines}
+		matcher, err := m.spec().Compile()
+		if err != nil {
+			return nil, errors.Wrapf(keywordError(err, len(mcfg.Keywords)), "mentions[%d] (%s)", i, mcfg.Name)
+		}
+		m.matcher = matcher
+		for j, ncfg := range ncfgs {
+			if _, err := notifier.New(ncfg); err != nil {
+				return nil, errors.Wrapf(err, "mentions[%d] (%s): notifiers[%d]", i, mcfg.Name, j)
+			}
+			m.notifiers = append(m.notifiers, ncfg)
+		}
+		mentions = append(mentions, m)
+	}
+	return mentions, nil
+}
+
+// match decides whether msg is a mention for m. self is the bot's own name,
+// its lines are never mentions.
+func (m mention) match(msg parser.RoomMsg, self string) (notifier.Notification, bool) {
+	var n notifier.Notification
+	switch msg := msg.(type) {
+	case parser.PublicMsg:
+		n = notifier.Notification{Title: "SSH Chat Mention", From: msg.From, Message: msg.Message}
+	case parser.ActionMsg:
+		if !m.Actions {
+			return n, false
+		}
+		n = notifier.Notification{Title: "SSH Chat Action", From: msg.From, Message: msg.Message}
+	case parser.PrivateMsg:
+		if !m.PrivateMessages {
+			return n, false
+		}
+		n = notifier.Notification{Title: "SSH Chat Private Message", From: msg.From, Message: msg.Message}
+	case parser.JoinMsg:
+		if !m.Joins || msg.Status != parser.UserJoined {
+			return n, false
+		}
+		n = notifier.Notification{Title: "SSH Chat Join", From: msg.Username, Message: "joined the room"}
+		if m.ignoreOwn && n.From == self {
+			return n, false
+		}
+		return n, m.found(n.From, n.From)
+	default:
+		// acks are our own lines echoed back, the rest is the server talking
+		return n, false
+	}
+	if m.ignoreOwn && n.From == self {
+		return n, false
+	}
+	return n, m.found(n.From, n.Message)
+}
+
+func (m mention) found(from, text string) bool {
+	p, ok := m.matcher.Match(from, text)
+	if ok {
+		lg.WithFields(lg.Fields{"cfg": m.Name, "pattern": p.String()}).
+			Info("Found keyword")
+	}
+	return ok
+}
+
+// resolveDelivery looks up the config of a dead letter's backend in the
+// current mentions, the dead letters don't keep it
+func resolveDelivery(mentions []mention, d *notifier.Delivery) error {
+	for _, m := range mentions {
+		if m.Name != d.Mention {
+			continue
+		}
+		if d.Notifier < 0 || d.Notifier >= len(m.notifiers) || !strings.EqualFold(m.notifiers[d.Notifier].Type, d.Type) {
+			return errors.Errorf("mention %s has no %s notifier at notifiers[%d] anymore", d.Mention, d.Type, d.Notifier)
+		}
+		d.Config = m.notifiers[d.Notifier]
+		return nil
+	}
+	return errors.Errorf("mention %s is no longer configured", d.Mention)
+}
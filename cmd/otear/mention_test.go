@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/voldyman/ssh-chat-notify/match"
+	"github.com/voldyman/ssh-chat-notify/notifier"
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+func compileMention(t *testing.T, mcfg MentionConfig) mention {
+	mentions, err := newMentions([]MentionConfig{mcfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mentions[0]
+}
+
+func TestMentionMatch(t *testing.T) {
+	plain := compileMention(t, MentionConfig{Keywords: []string{"voldy"}})
+	all := compileMention(t, MentionConfig{Keywords: []string{"voldy"}, Actions: true, PrivateMessages: true, Joins: true})
+
+	cases := []struct {
+		name string
+		m    mention
+		msg  parser.RoomMsg
+		want bool
+	}{
+		{"public", plain, parser.PublicMsg{From: "alice", Message: "ping voldy"}, true},
+		{"public without keyword", plain, parser.PublicMsg{From: "alice", Message: "hi all"}, false},
+		{"colon in message", plain, parser.PublicMsg{From: "alice", Message: "see https://voldy.example: now"}, true},
+		{"own line", plain, parser.PublicMsg{From: "otear-bot", Message: "voldy"}, false},
+		{"echoed ack", all, parser.AckMsg{Username: "otear-bot", Message: "voldy"}, false},
+		{"system", all, parser.SystemMsg{Message: "voldy"}, false},
+		{"action off", plain, parser.ActionMsg{From: "alice", Message: "pokes voldy"}, false},
+		{"action on", all, parser.ActionMsg{From: "alice", Message: "pokes voldy"}, true},
+		{"pm off", plain, parser.PrivateMsg{From: "alice", Message: "tell voldy"}, false},
+		{"pm on", all, parser.PrivateMsg{From: "alice", Message: "tell voldy"}, true},
+		{"join off", plain, parser.JoinMsg{Username: "voldyman", Status: parser.UserJoined}, false},
+		{"join on", all, parser.JoinMsg{Username: "voldyman", Status: parser.UserJoined}, true},
+		{"leave", all, parser.JoinMsg{Username: "voldyman", Status: parser.UserLeft}, false},
+	}
+	for _, c := range cases {
+		if _, got := c.m.match(c.msg, "otear-bot"); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMentionMatchesParsedLines(t *testing.T) {
+	m := compileMention(t, MentionConfig{Keywords: []string{"voldy"}})
+	p := parser.New()
+	lines := map[string]bool{
+		"alice: voldy: look at this":         true,
+		"** alice waves at voldy":            false,
+		"[PM from alice] hey voldy":          false,
+		" * voldyman joined. (Connected: 3)": false,
+	}
+	for line, want := range lines {
+		msg, err := p.Parse([]byte(line))
+		if err != nil {
+			t.Fatalf("unable to parse %q: %v", line, err)
+		}
+		n, got := m.match(msg, "otear-bot")
+		if got != want {
+			t.Errorf("%q: got %v, want %v", line, got, want)
+		}
+		if got && (n.From != "alice" || n.Message != "voldy: look at this") {
+			t.Errorf("%q: unexpected notification %+v", line, n)
+		}
+	}
+}
+
+func TestMentionSpec(t *testing.T) {
+	off := false
+	m := compileMention(t, MentionConfig{
+		Patterns: []match.Pattern{
+			{Match: "voldyman", Mode: match.ModeWord, IgnoreCase: true},
+			{Match: `deploy #\d+ failed`, Mode: match.ModeRegex},
+		},
+		Exclude:        []match.Pattern{{Match: "[bot]"}},
+		DenySenders:    []string{"ci-*"},
+		IgnoreOwnLines: &off,
+	})
+
+	cases := []struct {
+		from, message string
+		want          bool
+	}{
+		{"alice", "hey Voldyman, lunch?", true},
+		{"alice", "voldymanbot is down", false},
+		{"alice", "deploy #42 failed", true},
+		{"alice", "[bot] deploy #42 failed", false},
+		{"ci-runner", "voldyman: deploy #42 failed", false},
+		{"otear-bot", "voldyman", true},
+	}
+	for _, c := range cases {
+		_, got := m.match(parser.PublicMsg{From: c.from, Message: c.message}, "otear-bot")
+		if got != c.want {
+			t.Errorf("%s: %q got %v, want %v", c.from, c.message, got, c.want)
+		}
+	}
+}
+
+func TestMentionErrorsPointAtEntry(t *testing.T) {
+	cases := []struct {
+		mcfg MentionConfig
+		want string
+	}{
+		{MentionConfig{Name: "voldy", Keywords: []string{"a", ""}}, "mentions[0] (voldy): keywords[1]"},
+		{MentionConfig{Name: "voldy", Keywords: []string{"a"}, Patterns: []match.Pattern{{Match: "(", Mode: match.ModeRegex}}},
+			"mentions[0] (voldy): patterns[0] regex \"(\""},
+		{MentionConfig{Name: "voldy", Exclude: []match.Pattern{{Match: "x", Mode: "fuzzy"}}}, "exclude[0]"},
+	}
+	for _, c := range cases {
+		_, err := newMentions([]MentionConfig{c.mcfg})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("expected an error containing %q, got %v", c.want, err)
+		}
+	}
+}
+
+func TestResolveDelivery(t *testing.T) {
+	mentions, err := newMentions([]MentionConfig{{
+		Name:     "voldy",
+		Keywords: []string{"voldy"},
+		Notifiers: []notifier.Config{
+			{Type: "webhook", URL: "https://example.com/hook"},
+			{Type: "ntfy", URL: "https://ntfy.sh", Topic: "voldy"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := notifier.Delivery{Mention: "voldy", Notifier: 1, Type: "ntfy"}
+	if err := resolveDelivery(mentions, &d); err != nil || d.Config.Topic != "voldy" {
+		t.Fatalf("unexpected config %+v: %v", d.Config, err)
+	}
+	for _, gone := range []notifier.Delivery{
+		{Mention: "uno", Notifier: 0, Type: "webhook"},
+		{Mention: "voldy", Notifier: 2, Type: "webhook"},
+		{Mention: "voldy", Notifier: 0, Type: "ntfy"},
+	} {
+		if err := resolveDelivery(mentions, &gone); err == nil {
+			t.Errorf("resolved %+v to %+v", gone, gone.Config)
+		}
+	}
+}
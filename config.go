@@ -0,0 +1,53 @@
+package main
+
+import (
+	gconfig "github.com/gookit/config/v2"
+	jcfg "github.com/gookit/config/v2/json"
+	"github.com/pkg/errors"
+	"github.com/voldyman/ssh-chat-notify/mail"
+	"github.com/voldyman/ssh-chat-notify/notifyi"
+)
+
+type smtpConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+}
+
+type config struct {
+	SMTP smtpConfig `mapstructure:"smtp"`
+}
+
+func loadConfig(file string) (*config, error) {
+	var cfg config
+	if file == "" {
+		return &cfg, nil
+	}
+
+	gconfig.AddDriver(jcfg.Driver)
+	err := gconfig.LoadFiles(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load config file")
+	}
+	err = gconfig.BindStruct("", &cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to bind config struct")
+	}
+	return &cfg, nil
+}
+
+func botOptions(cfg *config) []notifyi.Option {
+	var opts []notifyi.Option
+	if cfg.SMTP.Host != "" {
+		opts = append(opts, notifyi.WithMailer(notifyi.NewSMTPMailer(mail.Config{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.SMTP.From,
+		})))
+	}
+	return opts
+}
@@ -14,7 +14,6 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/prataprc/goparsec v0.0.0-20211219142520-daac0e635e7e
-	github.com/shazow/rateio v0.0.0-20200113175441-4461efc8bdc4
 	github.com/sirupsen/logrus v1.9.0
 	golang.org/x/crypto v0.7.0
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -0,0 +1,135 @@
+// Package mail sends plain text mail through an SMTP server without letting
+// a stalled server hold on to the caller
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the server mail is relayed through
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// Timeout bounds the whole conversation with the server, zero means
+	// DefaultTimeout
+	Timeout time.Duration
+}
+
+// DefaultPort is the submission port used when Config.Port is zero
+const DefaultPort = 587
+
+// DefaultTimeout keeps a stalled SMTP server from holding up the caller for long
+const DefaultTimeout = 20 * time.Second
+
+// Message is a plain text mail, Date defaults to now
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+	Date    time.Time
+}
+
+// Send delivers msg. The conversation with the server ends by the earlier of
+// ctx's deadline and the configured timeout, it authenticates only when a
+// username is set.
+func Send(ctx context.Context, cfg Config, msg Message) error {
+	if len(msg.To) == 0 {
+		return errors.New("mail needs at least one recipient")
+	}
+	for _, header := range append([]string{msg.Subject}, msg.To...) {
+		if strings.ContainsAny(header, "\r\n") {
+			return errors.New("mail headers can't contain line breaks")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	deadline := time.Now().Add(cfg.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&data, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&data, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&data, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	data.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	data.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	data.WriteString("\r\n")
+
+	return send(cfg, deadline, msg.To, data.Bytes())
+}
+
+// send does what smtp.SendMail does on a connection with a deadline
+func send(cfg Config, deadline time.Time, to []string, data []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, time.Until(deadline))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("server doesn't support AUTH")
+		}
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
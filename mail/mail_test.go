@@ -0,0 +1,79 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/testutil"
+)
+
+func serverConfig(t *testing.T, addr string) Config {
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Config{Host: host, Port: portNum, From: "bot@example.com"}
+}
+
+func TestSend(t *testing.T) {
+	server, err := testutil.NewSMTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	msg := Message{To: []string{"alice@example.com", "bob@example.com"}, Subject: "hi", Body: "one\ntwo"}
+	if err := Send(context.Background(), serverConfig(t, server.Addr()), msg); err != nil {
+		t.Fatal(err)
+	}
+	sent := server.Mail()
+	if len(sent) != 1 || len(sent[0].To) != 2 {
+		t.Fatalf("expected one mail to both recipients, got %+v", sent)
+	}
+	if !strings.Contains(sent[0].Data, "Subject: hi\n") || !strings.Contains(sent[0].Data, "one\ntwo") {
+		t.Fatalf("unexpected mail:\n%s", sent[0].Data)
+	}
+}
+
+func TestSendRejectsHeaderBreaks(t *testing.T) {
+	msg := Message{To: []string{"alice@example.com"}, Subject: "hi\r\nBcc: eve@example.com"}
+	if err := Send(context.Background(), Config{Host: "localhost"}, msg); err == nil {
+		t.Fatal("sent a subject with a line break")
+	}
+}
+
+func TestSendStopsAtContextDeadline(t *testing.T) {
+	// accepts connections and never says anything
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := serverConfig(t, listener.Addr().String())
+	cfg.Timeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := Send(ctx, cfg, Message{To: []string{"alice@example.com"}}); err == nil {
+		t.Fatal("expected the stalled server to fail the mail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/alexcesaro/log"
 	"github.com/alexcesaro/log/golog"
+	flags "github.com/jessevdk/go-flags"
+	"github.com/voldyman/ssh-chat-notify/archive"
 	"github.com/voldyman/ssh-chat-notify/client"
 	"github.com/voldyman/ssh-chat-notify/notifyi"
 	"github.com/voldyman/ssh-chat-notify/parser"
@@ -15,8 +24,27 @@ const username = "notifyi"
 
 const sshChatHost = "localhost:2022"
 
+const eventBufferSize = 256
+
 var logger log.Logger
 
+type cliOptions struct {
+	Cfg            string   `short:"c" long:"config" description:"location of the config file"`
+	StorePath      string   `long:"store" description:"file the bot keeps users and watches in" default:"notifyi.json"`
+	ArchiveDir     string   `long:"archive" description:"directory every room line is archived in, empty disables the archive" default:"archive"`
+	KnownHosts     string   `long:"known-hosts" description:"known_hosts file used to verify the server"`
+	HostKeyMode    string   `long:"host-key-mode" description:"how to treat unknown host keys: tofu, strict or insecure" default:"tofu"`
+	Auth           []string `long:"auth" description:"auth method to try, in order given: agent, key or identity"`
+	KeyFiles       []string `short:"i" long:"key" description:"private key used by the key auth method"`
+	PassphraseEnv  string   `long:"passphrase-env" description:"environment variable holding the key passphrase"`
+	PassphraseFile string   `long:"passphrase-file" description:"file holding the key passphrase"`
+	IdentityFile   string   `long:"identity-file" description:"where the bot's own key is kept"`
+
+	Args struct {
+		Server string `positional-arg-name:"server" description:"ssh-chat address, defaults to localhost:2022"`
+	} `positional-args:"yes"`
+}
+
 func main() {
 	logger = golog.New(os.Stderr, log.Debug)
 
@@ -25,76 +53,232 @@ func main() {
 	}
 }
 
+// clientComms sends through whichever client the supervisor connected last
+// and waits for ssh-chat to confirm each line
 type clientComms struct {
+	ctx context.Context
+
+	mu     sync.Mutex
 	client *client.Client
 }
 
+func (c *clientComms) setClient(cl *client.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = cl
+}
+
+func (c *clientComms) send(line string, priority client.Priority) error {
+	c.mu.Lock()
+	cl := c.client
+	c.mu.Unlock()
+
+	if cl == nil {
+		return client.ErrClosed
+	}
+	delivery, err := cl.SendPriority(c.ctx, line, priority)
+	if err != nil {
+		return err
+	}
+	return delivery.Wait(c.ctx)
+}
+
 func (c *clientComms) PrivateMessage(toUsername, message string) error {
-	c.client.WriteLine(fmt.Sprintf("/msg %s %s", toUsername, message))
+	return c.send(fmt.Sprintf("/msg %s %s", toUsername, message), client.PriorityReply)
+}
+
+// Notification queues the PM behind command replies without waiting for it,
+// failures are only logged so one slow recipient doesn't hold up the room
+func (c *clientComms) Notification(toUsername, message string) error {
+	c.mu.Lock()
+	cl := c.client
+	c.mu.Unlock()
+
+	if cl == nil {
+		return client.ErrClosed
+	}
+	delivery, err := cl.SendPriority(c.ctx, fmt.Sprintf("/msg %s %s", toUsername, message), client.PriorityBulk)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := delivery.Wait(c.ctx); err != nil {
+			logger.Warning("Notification to", quote(toUsername), "failed:", err)
+		}
+	}()
 	return nil
 }
 
 func (c *clientComms) PublicMessage(message string) error {
-	c.client.WriteLine(message)
-	return nil
+	return c.send(message, client.PriorityNormal)
+}
+
+func clientOptions(opts cliOptions) ([]client.Option, error) {
+	mode, err := client.ParseHostKeyMode(opts.HostKeyMode)
+	if err != nil {
+		return nil, err
+	}
+	clientOpts := []client.Option{client.WithHostKeyMode(mode)}
+	if opts.KnownHosts != "" {
+		clientOpts = append(clientOpts, client.WithKnownHosts(opts.KnownHosts))
+	}
+	if opts.IdentityFile != "" {
+		clientOpts = append(clientOpts, client.WithIdentityFile(opts.IdentityFile))
+	}
+
+	sources, err := client.AuthConfig{
+		Methods:        opts.Auth,
+		KeyFiles:       opts.KeyFiles,
+		PassphraseEnv:  opts.PassphraseEnv,
+		PassphraseFile: opts.PassphraseFile,
+		IdentityFile:   opts.IdentityFile,
+	}.Sources()
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) > 0 {
+		clientOpts = append(clientOpts, client.WithAuth(sources...))
+	}
+	return clientOpts, nil
 }
 
 func run() error {
+	var opts cliOptions
+	if _, err := flags.Parse(&opts); err != nil {
+		if flags.WroteHelp(err) {
+			return nil
+		}
+		return err
+	}
+	clientOpts, err := clientOptions(opts)
+	if err != nil {
+		return err
+	}
+
 	dest := sshChatHost
-	if len(os.Args) >= 2 {
-		dest = os.Args[1]
+	if opts.Args.Server != "" {
+		dest = opts.Args.Server
 	}
 
-	client, err := client.CreateClient(dest, username)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	cfg, err := loadConfig(opts.Cfg)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
 
-	bot := notifyi.New(username, &clientComms{client})
-	lineParser := parser.New()
+	store, err := notifyi.NewFileStore(opts.StorePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
 
-	for {
-		line, err := client.ScanLine()
+	botOpts := append(botOptions(cfg), notifyi.WithStore(store), notifyi.WithErrorHandler(func(err error) {
+		logger.Warning("Background work failed:", err)
+	}))
+	var roomArchive *archive.Archive
+	if opts.ArchiveDir != "" {
+		roomArchive, err = archive.Open(opts.ArchiveDir)
 		if err != nil {
 			return err
 		}
+		defer roomArchive.Close()
+		botOpts = append(botOpts, notifyi.WithArchive(roomArchive))
+	}
 
-		fmt.Println("Got Line", line)
-		parsedResult, err := lineParser.Parse([]byte(line))
-		if err != nil {
-			logger.Warningf("parsing failed: %+v", err)
-			continue
+	comms := &clientComms{ctx: ctx}
+	bot := notifyi.New(username, comms, botOpts...)
+	defer bot.Drain()
+
+	supervisor := client.NewSupervisor(dest, username, clientOpts...)
+	supervisor.OnConnect = func(c *client.Client) {
+		logger.Info("Connected with key", c.Fingerprint())
+		comms.setClient(c)
+	}
+	supervisor.OnDisconnect = func(err error, retryIn time.Duration) {
+		comms.setClient(nil)
+		logger.Warning("Disconnected, retrying in", retryIn, ":", err)
+	}
+
+	err = supervisor.Run(ctx, func(ctx context.Context, c *client.Client) error {
+		// the bot waits for acks while handling an event, the buffer lets the
+		// client keep reading up to the ack
+		events := make(chan client.Event, eventBufferSize)
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- c.Run(ctx, events)
+		}()
+		if err := bot.Connected(); err != nil {
+			logger.Warning("unable to ask for the room's members:", err)
 		}
 
-		switch result := parsedResult.(type) {
-		case parser.PrivateMsg:
-			logger.Info("Private Message", quote(result.From), "->", result.Message)
-			bot.PrivateMessage(result.From, result.Message)
-
-		case parser.PublicMsg:
-			logger.Info("Public Message", quote(result.From), "->", result.Message)
-			bot.PublicMessage(result.From, result.Message)
-
-		case parser.ActionMsg:
-			logger.Info("Smartass says:", quote(result.From), "->", result.Message)
-			bot.ActionMessage(result.From, result.Message)
-
-		case parser.UsernameChangeMsg:
-			logger.Info("Nick change", quote(result.FromUsername), "->", result.ToUsername)
-			bot.UsernameChangeMessage(result.FromUsername, result.ToUsername)
-
-		case parser.JoinMsg:
-			switch result.Status {
-			case parser.UserJoined:
-				bot.UserJoinedMessage(result.Username)
-			case parser.UserLeft:
-				bot.UserLeftMessage(result.Username)
+		for event := range events {
+			fmt.Println("Got Line", event.Line)
+			if event.Msg == nil {
+				logger.Warningf("unable to parse line '%s'", event.Line)
+				continue
+			}
+			// PMs to the bot are commands, email addresses, verification
+			// codes and tell notes that must not outlive their expiry
+			if _, private := event.Msg.(parser.PrivateMsg); roomArchive != nil && !private {
+				if err := roomArchive.Add(time.Now(), event.Msg); err != nil {
+					logger.Warning("unable to archive line:", err)
+				}
 			}
-			logger.Info("User", quote(result.Username), "has", result.Status)
+			handleMessage(bot, event.Msg)
+		}
+		return <-runErr
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func handleMessage(bot *notifyi.Bot, msg parser.RoomMsg) {
+	switch result := msg.(type) {
+	case parser.PrivateMsg:
+		logger.Info("Private Message", quote(result.From), "->", result.Message)
+		bot.PrivateMessage(result.From, result.Message)
+
+	case parser.PublicMsg:
+		logger.Info("Public Message", quote(result.From), "->", result.Message)
+		bot.PublicMessage(result.From, result.Message)
+
+	case parser.ActionMsg:
+		logger.Info("Smartass says:", quote(result.From), "->", result.Message)
+		bot.ActionMessage(result.From, result.Message)
 
+	case parser.UsernameChangeMsg:
+		logger.Info("Nick change", quote(result.FromUsername), "->", result.ToUsername)
+		bot.UsernameChangeMessage(result.FromUsername, result.ToUsername)
+
+	case parser.JoinMsg:
+		switch result.Status {
+		case parser.UserJoined:
+			bot.UserJoinedMessage(result.Username)
+		case parser.UserLeft:
+			bot.UserLeftMessage(result.Username)
 		}
+		logger.Info("User", quote(result.Username), "has", result.Status)
+
+	case parser.AwayMsg:
+		logger.Info("User", quote(result.Username), "away:", result.Away, result.Reason)
+		bot.AwayMessage(result.Username, result.Away)
+
+	case parser.NamesMsg:
+		logger.Info("Connected users:", strings.Join(result.Names, ", "))
+		bot.NamesMessage(result.Names)
 
+	case parser.WhoisMsg:
+		bot.WhoisMessage(result.Field, result.Value)
 	}
 }
 
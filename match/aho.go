@@ -0,0 +1,107 @@
+package match
+
+// automaton is an Aho-Corasick automaton over ASCII-folded keys, it finds
+// every key in a line in one pass whatever the number of keys
+type automaton struct {
+	nodes   []acNode
+	watches []*watch
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	// out holds the watches whose key ends here, including those that end
+	// in a suffix of this node's path
+	out []int32
+}
+
+// foldASCII lowercases ASCII letters only so byte offsets stay the same
+// in the folded line and the original
+func foldASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+func buildAutomaton(watches []*watch) *automaton {
+	a := &automaton{nodes: []acNode{{}}, watches: watches}
+	for i, w := range watches {
+		key := foldASCII(w.key)
+		var state int32
+		for j := 0; j < len(key); j++ {
+			next, ok := a.nodes[state].next[key[j]]
+			if !ok {
+				a.nodes = append(a.nodes, acNode{})
+				next = int32(len(a.nodes) - 1)
+				if a.nodes[state].next == nil {
+					a.nodes[state].next = map[byte]int32{}
+				}
+				a.nodes[state].next[key[j]] = next
+			}
+			state = next
+		}
+		a.nodes[state].out = append(a.nodes[state].out, int32(i))
+	}
+
+	// failure links point at the longest proper suffix that is also a
+	// prefix of some key, they are set breadth first so parents come first
+	queue := make([]int32, 0, len(a.nodes))
+	for _, child := range a.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for c, v := range a.nodes[u].next {
+			f := a.nodes[u].fail
+			for {
+				if t, ok := a.nodes[f].next[c]; ok && t != v {
+					a.nodes[v].fail = t
+					break
+				}
+				if f == 0 {
+					a.nodes[v].fail = 0
+					break
+				}
+				f = a.nodes[f].fail
+			}
+			a.nodes[v].out = append(a.nodes[v].out, a.nodes[a.nodes[v].fail].out...)
+			queue = append(queue, v)
+		}
+	}
+	return a
+}
+
+// scan calls fn for every key found in folded with the byte range it covers
+func (a *automaton) scan(folded string, fn func(w *watch, start, end int)) {
+	if a == nil || len(a.watches) == 0 {
+		return
+	}
+	var state int32
+	for i := 0; i < len(folded); i++ {
+		c := folded[i]
+		for {
+			if next, ok := a.nodes[state].next[c]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = a.nodes[state].fail
+		}
+		for _, o := range a.nodes[state].out {
+			w := a.watches[o]
+			fn(w, i+1-len(w.key), i+1)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package match
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPatternModes(t *testing.T) {
+	cases := []struct {
+		p    Pattern
+		line string
+		want bool
+	}{
+		{Pattern{Match: "voldy"}, "hi voldyman", true},
+		{Pattern{Match: "voldy"}, "hi Voldyman", false},
+		{Pattern{Match: "voldy", IgnoreCase: true}, "hi VOLDYman", true},
+		{Pattern{Match: "a.b", IgnoreCase: true}, "axb", false},
+
+		{Pattern{Match: "voldyman", Mode: ModeWord}, "voldyman: hi", true},
+		{Pattern{Match: "voldyman", Mode: ModeWord}, "ask voldyman", true},
+		{Pattern{Match: "voldyman", Mode: ModeWord}, "voldymanbot is up", false},
+		{Pattern{Match: "voldyman", Mode: ModeWord}, "@voldyman_ hi", false},
+		{Pattern{Match: "voldyman", Mode: ModeWord}, "Voldyman", false},
+		{Pattern{Match: "voldyman", Mode: ModeWord, IgnoreCase: true}, "(Voldyman)", true},
+		{Pattern{Match: "café", Mode: ModeWord}, "le caféine", false},
+
+		{Pattern{Match: `^deploy \d+`, Mode: ModeRegex}, "deploy 12 done", true},
+		{Pattern{Match: `^deploy \d+`, Mode: ModeRegex}, "the deploy 12", false},
+		{Pattern{Match: `fail(ed|ure)`, Mode: ModeRegex, IgnoreCase: true}, "FAILURE", true},
+
+		{Pattern{Match: "*voldy*", Mode: ModeGlob}, "hey voldyman", true},
+		{Pattern{Match: "voldy*", Mode: ModeGlob}, "hey voldyman", false},
+		{Pattern{Match: "build ? [!a-c]*", Mode: ModeGlob}, "build 7 done", true},
+		{Pattern{Match: "build ? [!a-c]*", Mode: ModeGlob}, "build 7 broken", false},
+		{Pattern{Match: `*\*`, Mode: ModeGlob}, "stars*", true},
+		{Pattern{Match: "*.go", Mode: ModeGlob}, "main_go", false},
+	}
+	for _, c := range cases {
+		compiled, err := c.p.compile()
+		if err != nil {
+			t.Errorf("%s: %v", c.p, err)
+			continue
+		}
+		if got := compiled.match(c.line); got != c.want {
+			t.Errorf("%s on %q: got %v, want %v", c.p, c.line, got, c.want)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m, err := Spec{
+		Patterns:     []Pattern{{Match: "voldyman", Mode: ModeWord, IgnoreCase: true}},
+		Exclude:      []Pattern{{Match: "ignore me", IgnoreCase: true}},
+		AllowSenders: []string{"alice", "bob*"},
+		DenySenders:  []string{"bobby"},
+	}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		from, line string
+		want       bool
+	}{
+		{"alice", "hi voldyman", true},
+		{"ALICE", "hi voldyman", true},
+		{"bob2", "hi voldyman", true},
+		{"bobby", "hi voldyman", false},
+		{"mallory", "hi voldyman", false},
+		{"alice", "voldyman: IGNORE ME", false},
+		{"alice", "hi everyone", false},
+	}
+	for _, c := range cases {
+		p, got := m.Match(c.from, c.line)
+		if got != c.want {
+			t.Errorf("%s: %q got %v, want %v", c.from, c.line, got, c.want)
+		}
+		if got && p.Match != "voldyman" {
+			t.Errorf("unexpected pattern %s", p)
+		}
+	}
+}
+
+func TestCompileErrorsPointAtEntry(t *testing.T) {
+	cases := []struct {
+		spec  Spec
+		field string
+		index int
+	}{
+		{Spec{Patterns: []Pattern{{Match: "ok"}, {Match: "(", Mode: ModeRegex}}}, "patterns", 1},
+		{Spec{Patterns: []Pattern{{Match: "x", Mode: "fuzzy"}}}, "patterns", 0},
+		{Spec{Exclude: []Pattern{{}}}, "exclude", 0},
+		{Spec{AllowSenders: []string{"alice", "[bob"}}, "allow-senders", 1},
+		{Spec{DenySenders: []string{`bob\`}}, "deny-senders", 0},
+	}
+	for _, c := range cases {
+		_, err := c.spec.Compile()
+		var entryErr *EntryError
+		if !errors.As(err, &entryErr) {
+			t.Errorf("expected an EntryError, got %v", err)
+			continue
+		}
+		if entryErr.Field != c.field || entryErr.Index != c.index {
+			t.Errorf("error points at %s[%d], want %s[%d]: %v", entryErr.Field, entryErr.Index, c.field, c.index, err)
+		}
+	}
+}
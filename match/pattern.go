@@ -0,0 +1,132 @@
+// Package match decides whether chat lines contain what someone is
+// watching for
+package match
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Mode is how a pattern's text is interpreted
+type Mode string
+
+const (
+	// ModeLiteral matches the text anywhere in a line
+	ModeLiteral Mode = "literal"
+	// ModeWord matches the text when it isn't part of a longer word
+	ModeWord Mode = "word"
+	// ModeRegex matches a Go regular expression anywhere in a line
+	ModeRegex Mode = "regex"
+	// ModeGlob matches the whole line against a shell glob, * ? and [...]
+	ModeGlob Mode = "glob"
+)
+
+// Modes are the modes a Pattern can use
+var Modes = []Mode{ModeLiteral, ModeWord, ModeRegex, ModeGlob}
+
+// Pattern is one thing to look for, an empty mode means literal
+type Pattern struct {
+	Match      string `mapstructure:"match"`
+	Mode       Mode   `mapstructure:"mode"`
+	IgnoreCase bool   `mapstructure:"ignore-case"`
+}
+
+func (p Pattern) String() string {
+	mode := p.Mode
+	if mode == "" {
+		mode = ModeLiteral
+	}
+	if p.IgnoreCase {
+		return fmt.Sprintf("%s/i %q", mode, p.Match)
+	}
+	return fmt.Sprintf("%s %q", mode, p.Match)
+}
+
+// compiled is a pattern ready to test lines, re is nil for case-sensitive
+// literals which are a plain substring search
+type compiled struct {
+	Pattern
+	re *regexp.Regexp
+}
+
+func (c compiled) match(line string) bool {
+	if c.re == nil {
+		return strings.Contains(line, c.Match)
+	}
+	return c.re.MatchString(line)
+}
+
+// wordEdge is what has to surround a whole word, Go's \b only knows ASCII
+const wordEdge = `[^\p{L}\p{N}_]`
+
+func (p Pattern) compile() (compiled, error) {
+	if p.Match == "" {
+		return compiled{}, errors.New("empty pattern")
+	}
+
+	var expr string
+	switch p.Mode {
+	case "", ModeLiteral:
+		if !p.IgnoreCase {
+			return compiled{Pattern: p}, nil
+		}
+		expr = regexp.QuoteMeta(p.Match)
+	case ModeWord:
+		expr = `(?:^|` + wordEdge + `)` + regexp.QuoteMeta(p.Match) + `(?:$|` + wordEdge + `)`
+	case ModeRegex:
+		expr = p.Match
+	case ModeGlob:
+		var err error
+		if expr, err = globToRegexp(p.Match); err != nil {
+			return compiled{}, err
+		}
+	default:
+		return compiled{}, fmt.Errorf("unknown mode '%s', use one of %v", p.Mode, Modes)
+	}
+
+	if p.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return compiled{}, err
+	}
+	return compiled{Pattern: p, re: re}, nil
+}
+
+// globToRegexp anchors a glob to the whole line
+func globToRegexp(glob string) (string, error) {
+	var expr strings.Builder
+	expr.WriteString(`^`)
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr.WriteString(`.*`)
+		case '?':
+			expr.WriteString(`.`)
+		case '\\':
+			if i+1 == len(glob) {
+				return "", errors.New("glob ends with an escape")
+			}
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", errors.New("glob has an unclosed [")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString(`$`)
+	return expr.String(), nil
+}
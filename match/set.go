@@ -0,0 +1,362 @@
+package match
+
+import (
+	"regexp/syntax"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// minDelta is how many recent watches the delta automaton can hold before
+// they are merged into the base, larger sets allow a delta an eighth their size
+const minDelta = 64
+
+// Hit is a watch that matched a line
+type Hit struct {
+	Owner string
+	Watch string
+}
+
+// watch is one registered pattern, seq keeps the order it was added in.
+// key is what the automaton looks for: the text itself for literals and
+// words, and for other patterns a literal every match has to contain. A
+// watch without a key is tried on every line.
+type watch struct {
+	owner string
+	id    string
+	seq   uint64
+	compiled
+	key  string
+	dead bool
+}
+
+func newWatch(owner, id string, seq uint64, c compiled) *watch {
+	w := &watch{owner: owner, id: id, seq: seq, compiled: c}
+	if w.plain() {
+		w.key = c.Pattern.Match
+	} else if c.re != nil {
+		w.key = requiredLiteral(c.re.String())
+	}
+	return w
+}
+
+// plain reports whether the automaton finding w's text is enough, with a
+// check for case and word edges. Folding has to keep the key's length so
+// only ASCII text can ignore case this way.
+func (w *watch) plain() bool {
+	switch w.Pattern.Mode {
+	case "", ModeLiteral, ModeWord:
+		return !w.Pattern.IgnoreCase || isASCII(w.Pattern.Match)
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// verify confirms a key found between start and end is a match
+func (w *watch) verify(line string, start, end int) bool {
+	if !w.plain() {
+		return w.re.MatchString(line)
+	}
+	if !w.Pattern.IgnoreCase && line[start:end] != w.Pattern.Match {
+		return false
+	}
+	if w.Pattern.Mode == ModeWord {
+		if r, _ := utf8.DecodeLastRuneInString(line[:start]); start > 0 && isWordRune(r) {
+			return false
+		}
+		if r, _ := utf8.DecodeRuneInString(line[end:]); end < len(line) && isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordRune agrees with wordEdge
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// requiredLiteral finds the longest literal every match of expr contains,
+// empty when there is none the automaton can look for
+func requiredLiteral(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	return longestLiteral(re.Simplify())
+}
+
+func longestLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return string(re.Rune)
+		}
+		// only ASCII folds without changing length, the longest ASCII
+		// run still has to be in every match
+		var longest, run []rune
+		for _, r := range append(re.Rune, utf8.RuneError) {
+			if r < utf8.RuneSelf {
+				run = append(run, r)
+				continue
+			}
+			if len(run) > len(longest) {
+				longest = run
+			}
+			run = nil
+		}
+		return string(longest)
+	case syntax.OpCapture, syntax.OpPlus:
+		return longestLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		var longest string
+		for _, sub := range re.Sub {
+			if lit := longestLiteral(sub); len(lit) > len(longest) {
+				longest = lit
+			}
+		}
+		return longest
+	}
+	return ""
+}
+
+// Set finds every watch of every owner that matches a line. Literal and
+// whole-word watches are found by an Aho-Corasick automaton, so are the
+// literals regexes and globs require, and only then the regex is run.
+//
+// Changes don't rebuild everything: new watches go to a small delta
+// automaton and removed watches are skipped until enough of them pile up,
+// then the base is rebuilt from the live watches.
+type Set struct {
+	mu      sync.RWMutex
+	owners  map[string]map[string]*watch
+	nextSeq uint64
+
+	base   *automaton
+	delta  *automaton
+	recent []*watch
+	// always holds the watches without a key
+	always []*watch
+	// stale counts dead watches still held by base, recent or always
+	stale int
+}
+
+// NewSet creates an empty set
+func NewSet() *Set {
+	return &Set{owners: map[string]map[string]*watch{}}
+}
+
+// Add registers p as owner's watch id, replacing a watch with the same id
+func (s *Set) Add(owner, id string, p Pattern) error {
+	c, err := p.compile()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(owner, id)
+	s.add(owner, id, c)
+	s.settle()
+	return nil
+}
+
+// Remove drops owner's watch id, it reports whether there was one
+func (s *Set) Remove(owner, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := s.remove(owner, id)
+	s.settle()
+	return removed
+}
+
+// Replace makes patterns, named by ids, the only watches of owner in that
+// order. Watches that didn't change are kept so a small edit stays cheap.
+func (s *Set) Replace(owner string, ids []string, patterns []Pattern) error {
+	all := make([]compiled, len(patterns))
+	for i, p := range patterns {
+		c, err := p.compile()
+		if err != nil {
+			return &EntryError{Field: owner, Index: i, Entry: p.String(), Err: err}
+		}
+		all[i] = c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// watches are kept while the list starts the same, the rest are added
+	// again so their order follows the list
+	current := s.owners[owner]
+	same := 0
+	for ; same < len(ids); same++ {
+		w, ok := current[ids[same]]
+		if !ok || w.Pattern != all[same].Pattern {
+			break
+		}
+		if same > 0 && w.seq < current[ids[same-1]].seq {
+			break
+		}
+	}
+	keep := make(map[string]bool, same)
+	for _, id := range ids[:same] {
+		keep[id] = true
+	}
+	for id := range current {
+		if !keep[id] {
+			s.remove(owner, id)
+		}
+	}
+	for i := same; i < len(ids); i++ {
+		s.remove(owner, ids[i])
+		s.add(owner, ids[i], all[i])
+	}
+	s.settle()
+	return nil
+}
+
+// add and remove must be called with mu held and followed by settle
+func (s *Set) add(owner, id string, c compiled) {
+	s.nextSeq++
+	w := newWatch(owner, id, s.nextSeq, c)
+	if s.owners[owner] == nil {
+		s.owners[owner] = map[string]*watch{}
+	}
+	s.owners[owner][id] = w
+	if w.key != "" {
+		s.recent = append(s.recent, w)
+	} else {
+		s.always = append(s.always, w)
+	}
+}
+
+func (s *Set) remove(owner, id string) bool {
+	w, ok := s.owners[owner][id]
+	if !ok {
+		return false
+	}
+	w.dead = true
+	s.stale++
+	delete(s.owners[owner], id)
+	if len(s.owners[owner]) == 0 {
+		delete(s.owners, owner)
+	}
+	return true
+}
+
+// settle brings the automata up to date, the delta is rebuilt on every
+// change and the base only once the delta or the dead watches grow too big
+func (s *Set) settle() {
+	live := 0
+	for _, watches := range s.owners {
+		live += len(watches)
+	}
+	limit := live / 8
+	if limit < minDelta {
+		limit = minDelta
+	}
+	if len(s.recent) > limit || s.stale > limit {
+		s.compact()
+		return
+	}
+	s.recent = s.dropDead(s.recent)
+	s.always = s.dropDead(s.always)
+	s.delta = buildAutomaton(s.recent)
+}
+
+func (s *Set) dropDead(watches []*watch) []*watch {
+	live := watches[:0]
+	for _, w := range watches {
+		if w.dead {
+			s.stale--
+			continue
+		}
+		live = append(live, w)
+	}
+	for i := len(live); i < len(watches); i++ {
+		watches[i] = nil
+	}
+	return live
+}
+
+// compact rebuilds everything from the live watches
+func (s *Set) compact() {
+	var keyed, always []*watch
+	for _, watches := range s.owners {
+		for _, w := range watches {
+			if w.key != "" {
+				keyed = append(keyed, w)
+			} else {
+				always = append(always, w)
+			}
+		}
+	}
+	s.base = buildAutomaton(keyed)
+	s.delta = nil
+	s.recent = nil
+	s.always = always
+	s.stale = 0
+}
+
+// Match returns every watch that matches line, ordered by owner and then
+// by the order the owner's watches were added in
+func (s *Set) Match(line string) []Hit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found []*watch
+	// a key can be found more than once, tried remembers what was checked
+	tried := map[*watch]bool{}
+	folded := foldASCII(line)
+	check := func(w *watch, start, end int) {
+		if w.dead || tried[w] {
+			return
+		}
+		if !w.plain() {
+			// a regex only has to be run once whatever the position
+			tried[w] = true
+		}
+		if w.verify(line, start, end) {
+			tried[w] = true
+			found = append(found, w)
+		}
+	}
+	s.base.scan(folded, check)
+	s.delta.scan(folded, check)
+	for _, w := range s.always {
+		if !w.dead && w.re.MatchString(line) {
+			found = append(found, w)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].owner != found[j].owner {
+			return found[i].owner < found[j].owner
+		}
+		return found[i].seq < found[j].seq
+	})
+	hits := make([]Hit, len(found))
+	for i, w := range found {
+		hits[i] = Hit{Owner: w.owner, Watch: w.id}
+	}
+	return hits
+}
+
+// Len is how many watches the set holds
+func (s *Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, watches := range s.owners {
+		n += len(watches)
+	}
+	return n
+}
@@ -0,0 +1,258 @@
+package match
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSetMatch(t *testing.T) {
+	s := NewSet()
+	add := func(owner, id string, p Pattern) {
+		if err := s.Add(owner, id, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("alice", "deploy", Pattern{Match: "deploy", IgnoreCase: true})
+	add("alice", "go", Pattern{Match: "go", Mode: ModeWord, IgnoreCase: true})
+	add("bob", "Go", Pattern{Match: "Go"})
+	add("bob", "issues", Pattern{Match: `#\d+`, Mode: ModeRegex})
+	add("carol", "café", Pattern{Match: "CAFÉ", IgnoreCase: true})
+	add("dave", "glob", Pattern{Match: "*deploy*", Mode: ModeGlob})
+
+	cases := []struct {
+		line string
+		want []Hit
+	}{
+		{"Deploy of #12 is done, let's go", []Hit{{"alice", "deploy"}, {"alice", "go"}, {"bob", "issues"}}},
+		{"Going to the café", []Hit{{"bob", "Go"}, {"carol", "café"}}},
+		{"we deploy on Go", []Hit{{"alice", "deploy"}, {"alice", "go"}, {"bob", "Go"}, {"dave", "glob"}}},
+		{"nothing here", nil},
+	}
+	for _, c := range cases {
+		if got := s.Match(c.line); !reflect.DeepEqual(got, c.want) && !(len(got) == 0 && len(c.want) == 0) {
+			t.Errorf("%q: got %v, want %v", c.line, got, c.want)
+		}
+	}
+
+	if !s.Remove("alice", "go") || s.Remove("alice", "go") {
+		t.Error("expected exactly one removal")
+	}
+	if got := s.Match("let's go"); len(got) != 0 {
+		t.Errorf("removed watch still matches: %v", got)
+	}
+	if err := s.Add("alice", "bad", Pattern{Match: "(", Mode: ModeRegex}); err == nil {
+		t.Error("expected an invalid regex to be rejected")
+	}
+}
+
+func TestSetReplaceKeepsOrder(t *testing.T) {
+	s := NewSet()
+	lit := func(words ...string) []Pattern {
+		var ps []Pattern
+		for _, w := range words {
+			ps = append(ps, Pattern{Match: w, IgnoreCase: true})
+		}
+		return ps
+	}
+	if err := s.Replace("alice", []string{"a", "b", "c"}, lit("xa", "xb", "xc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace("alice", []string{"c", "a"}, lit("xc", "xa")); err != nil {
+		t.Fatal(err)
+	}
+	want := []Hit{{"alice", "c"}, {"alice", "a"}}
+	if got := s.Match("xa xb xc"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected 2 watches, got %d", s.Len())
+	}
+}
+
+// reference is what Set has to agree with, every pattern tried on its own
+type reference map[string]map[string]compiled
+
+func (r reference) match(line string) []Hit {
+	var hits []Hit
+	for owner, watches := range r {
+		for id, c := range watches {
+			if c.match(line) {
+				hits = append(hits, Hit{owner, id})
+			}
+		}
+	}
+	sortHits(hits)
+	return hits
+}
+
+func sortHits(hits []Hit) {
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Owner != hits[j].Owner {
+			return hits[i].Owner < hits[j].Owner
+		}
+		return hits[i].Watch < hits[j].Watch
+	})
+}
+
+var vocabulary = strings.Fields("go Go GO gopher deploy Deploy release build ci café CAFÉ naïve voldy voldyman bob bobby x xx ab ba aba")
+
+func randomPattern(rng *rand.Rand) Pattern {
+	word := vocabulary[rng.Intn(len(vocabulary))]
+	switch rng.Intn(5) {
+	case 0:
+		return Pattern{Match: word, Mode: ModeWord, IgnoreCase: rng.Intn(2) == 0}
+	case 1:
+		return Pattern{Match: word + `\b`, Mode: ModeRegex}
+	case 2:
+		return Pattern{Match: "*" + word + "*", Mode: ModeGlob, IgnoreCase: true}
+	}
+	return Pattern{Match: word, IgnoreCase: rng.Intn(2) == 0}
+}
+
+func randomLine(rng *rand.Rand) string {
+	var words []string
+	for n := rng.Intn(8); n >= 0; n-- {
+		w := vocabulary[rng.Intn(len(vocabulary))]
+		if rng.Intn(4) == 0 {
+			w += vocabulary[rng.Intn(len(vocabulary))]
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, []string{" ", ", ", "-", ": "}[rng.Intn(4)])
+}
+
+func TestSetAgreesWithLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	s := NewSet()
+	ref := reference{}
+
+	for round := 0; round < 3000; round++ {
+		owner := fmt.Sprintf("owner%d", rng.Intn(40))
+		id := fmt.Sprintf("w%d", rng.Intn(8))
+		switch op := rng.Intn(10); {
+		case op < 6:
+			p := randomPattern(rng)
+			if err := s.Add(owner, id, p); err != nil {
+				t.Fatal(err)
+			}
+			c, _ := p.compile()
+			if ref[owner] == nil {
+				ref[owner] = map[string]compiled{}
+			}
+			ref[owner][id] = c
+		case op < 9:
+			_, had := ref[owner][id]
+			if s.Remove(owner, id) != had {
+				t.Fatalf("round %d: Remove(%s, %s) disagreed", round, owner, id)
+			}
+			delete(ref[owner], id)
+		default:
+			var ids []string
+			var ps []Pattern
+			ref[owner] = map[string]compiled{}
+			for i := rng.Intn(5); i > 0; i-- {
+				id := fmt.Sprintf("w%d", rng.Intn(8))
+				if _, dup := ref[owner][id]; dup {
+					continue
+				}
+				p := randomPattern(rng)
+				c, _ := p.compile()
+				ids, ps = append(ids, id), append(ps, p)
+				ref[owner][id] = c
+			}
+			if err := s.Replace(owner, ids, ps); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		line := randomLine(rng)
+		got := s.Match(line)
+		sortHits(got)
+		if want := ref.match(line); !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+			t.Fatalf("round %d: %q\ngot  %v\nwant %v", round, line, got, want)
+		}
+	}
+}
+
+// benchmarkWatches builds n watches the way notifyi users write them,
+// case-insensitive words with a few regexes mixed in
+func benchmarkWatches(n int) ([]string, []string, []Pattern) {
+	rng := rand.New(rand.NewSource(int64(n)))
+	owners := make([]string, n)
+	ids := make([]string, n)
+	patterns := make([]Pattern, n)
+	for i := range patterns {
+		owners[i] = fmt.Sprintf("SHA256:user%d", i/5)
+		word := fmt.Sprintf("%s%d", vocabulary[rng.Intn(len(vocabulary))], rng.Intn(n))
+		ids[i] = word
+		patterns[i] = Pattern{Match: word, IgnoreCase: true}
+		if i%50 == 0 {
+			patterns[i] = Pattern{Match: `build #` + word, Mode: ModeRegex, IgnoreCase: true}
+		}
+	}
+	return owners, ids, patterns
+}
+
+const benchmarkLine = "alice: has anyone looked at the release notes for build #4312? the deploy7 job failed on ci again"
+
+func BenchmarkSetMatch(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		owners, ids, patterns := benchmarkWatches(n)
+		s := NewSet()
+		for i := range patterns {
+			if err := s.Add(owners[i], ids[i], patterns[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.Match(benchmarkLine)
+			}
+		})
+	}
+}
+
+// BenchmarkLinearScan is the loop notifyi used before Set, every watch
+// lowercased and searched for on its own
+func BenchmarkLinearScan(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		owners, _, patterns := benchmarkWatches(n)
+		compiledAll := make([]compiled, n)
+		for i, p := range patterns {
+			compiledAll[i], _ = p.compile()
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				lowered := strings.ToLower(benchmarkLine)
+				var hits []Hit
+				for j, c := range compiledAll {
+					var matched bool
+					if c.re != nil && c.Mode == ModeRegex {
+						matched = c.re.MatchString(benchmarkLine)
+					} else {
+						matched = strings.Contains(lowered, strings.ToLower(c.Match))
+					}
+					if matched {
+						hits = append(hits, Hit{owners[j], c.Match})
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSetAdd(b *testing.B) {
+	owners, ids, patterns := benchmarkWatches(10000)
+	s := NewSet()
+	for i := range patterns {
+		s.Add(owners[i], ids[i], patterns[i])
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Add("SHA256:new", "watch", Pattern{Match: fmt.Sprint("token", i), IgnoreCase: true})
+	}
+}
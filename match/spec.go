@@ -0,0 +1,111 @@
+package match
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Spec is everything that decides whether a line from someone is a match
+type Spec struct {
+	// Patterns are what to look for, any one of them matching is enough
+	Patterns []Pattern
+	// Exclude cancels a match when any of these is in the line
+	Exclude []Pattern
+	// AllowSenders, when not empty, limits matches to these senders
+	AllowSenders []string
+	// DenySenders never match, they win over AllowSenders. Sender entries
+	// are globs and ignore case.
+	DenySenders []string
+}
+
+// EntryError points at the entry of a Spec that didn't compile
+type EntryError struct {
+	Field string
+	Index int
+	Entry string
+	Err   error
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s[%d] %s: %v", e.Field, e.Index, e.Entry, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// Matcher is a compiled Spec
+type Matcher struct {
+	patterns []compiled
+	exclude  []compiled
+	allow    []compiled
+	deny     []compiled
+}
+
+// Compile checks every entry of s and prepares it for matching
+func (s Spec) Compile() (*Matcher, error) {
+	var m Matcher
+	var err error
+	if m.patterns, err = compileAll("patterns", s.Patterns); err != nil {
+		return nil, err
+	}
+	if m.exclude, err = compileAll("exclude", s.Exclude); err != nil {
+		return nil, err
+	}
+	if m.allow, err = compileSenders("allow-senders", s.AllowSenders); err != nil {
+		return nil, err
+	}
+	if m.deny, err = compileSenders("deny-senders", s.DenySenders); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func compileAll(field string, patterns []Pattern) ([]compiled, error) {
+	all := make([]compiled, 0, len(patterns))
+	for i, p := range patterns {
+		c, err := p.compile()
+		if err != nil {
+			return nil, &EntryError{Field: field, Index: i, Entry: p.String(), Err: err}
+		}
+		all = append(all, c)
+	}
+	return all, nil
+}
+
+func compileSenders(field string, senders []string) ([]compiled, error) {
+	patterns := make([]Pattern, 0, len(senders))
+	for _, s := range senders {
+		patterns = append(patterns, Pattern{Match: strings.TrimSpace(s), Mode: ModeGlob, IgnoreCase: true})
+	}
+	return compileAll(field, patterns)
+}
+
+// Match reports the first pattern found in line from sender, a sender that
+// isn't allowed or a line with an excluded pattern never matches
+func (m *Matcher) Match(sender, line string) (Pattern, bool) {
+	if anyMatch(m.deny, sender) {
+		return Pattern{}, false
+	}
+	if len(m.allow) > 0 && !anyMatch(m.allow, sender) {
+		return Pattern{}, false
+	}
+	for _, p := range m.patterns {
+		if p.match(line) {
+			if anyMatch(m.exclude, line) {
+				return Pattern{}, false
+			}
+			return p.Pattern, true
+		}
+	}
+	return Pattern{}, false
+}
+
+func anyMatch(patterns []compiled, s string) bool {
+	for _, p := range patterns {
+		if p.match(s) {
+			return true
+		}
+	}
+	return false
+}
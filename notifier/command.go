@@ -0,0 +1,54 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command runs a program for every notification. It gets the message on
+// standard input and NOTIFY_TITLE, NOTIFY_FROM, NOTIFY_MESSAGE and
+// NOTIFY_TIME in its environment.
+type Command struct {
+	Args []string
+}
+
+// NewCommand creates a notifier running args, the first one is the program
+func NewCommand(args []string) (*Command, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("command needs a program to run")
+	}
+	return &Command{Args: args}, nil
+}
+
+func (c *Command) Notify(ctx context.Context, n Notification) error {
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"NOTIFY_TITLE="+n.Title,
+		"NOTIFY_FROM="+n.From,
+		"NOTIFY_MESSAGE="+n.Message,
+		"NOTIFY_TIME="+n.Time.Format(time.RFC3339),
+	)
+	cmd.Stdin = strings.NewReader(n.Text() + "\n")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(output.String())
+		if out == "" {
+			return fmt.Errorf("%s failed: %w", c.Args[0], err)
+		}
+		return fmt.Errorf("%s failed: %w: %s", c.Args[0], err, out)
+	}
+	return nil
+}
+
+func (c *Command) String() string {
+	return "command " + c.Args[0]
+}
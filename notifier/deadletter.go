@@ -0,0 +1,195 @@
+package notifier
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DeadLetters is a JSON Lines file of deliveries that could not be made.
+// It holds what was said in the room so it is only readable by its owner.
+type DeadLetters struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewDeadLetters uses the file at path, it is created on the first failure
+func NewDeadLetters(path string) *DeadLetters {
+	return &DeadLetters{path: path}
+}
+
+// Path is where the dead letters are kept
+func (l *DeadLetters) Path() string {
+	return l.path
+}
+
+// Add appends d to the file
+func (l *DeadLetters) Add(d Delivery) error {
+	line, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("unable to encode dead letter: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open dead letters: %w", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write dead letter: %w", err)
+	}
+	return f.Close()
+}
+
+// Load reads every dead letter, including those of a replay that was
+// interrupted. A missing file has none.
+func (l *DeadLetters) Load() ([]Delivery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	replaying, err := readDeadLetters(l.replayingPath())
+	if err != nil {
+		return nil, err
+	}
+	all, err := readDeadLetters(l.path)
+	if err != nil {
+		return nil, err
+	}
+	return append(replaying, all...), nil
+}
+
+// replayingPath is where the dead letters being replayed are kept
+func (l *DeadLetters) replayingPath() string {
+	return l.path + ".replaying"
+}
+
+func readDeadLetters(path string) ([]Delivery, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open dead letters: %w", err)
+	}
+	defer f.Close()
+
+	var all []Delivery
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var d Delivery
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("unable to parse dead letter on line %d: %w", lineNo, err)
+		}
+		all = append(all, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read dead letters: %w", err)
+	}
+	return all, nil
+}
+
+// Replay calls deliver for every dead letter and keeps the ones that fail.
+// deliver is handed the letter without its backend's config and has to look
+// it up. The file is moved aside first so a running otear can keep adding to
+// it, and what is left to replay is rewritten after every letter so an
+// interrupted replay is picked up by the next one without sending anything
+// twice.
+func (l *DeadLetters) Replay(ctx context.Context, deliver func(*Delivery) error) (sent, failed int, err error) {
+	replaying := l.replayingPath()
+
+	l.mu.Lock()
+	if _, statErr := os.Stat(replaying); os.IsNotExist(statErr) {
+		if err := os.Rename(l.path, replaying); err != nil {
+			l.mu.Unlock()
+			if os.IsNotExist(err) {
+				return 0, 0, nil
+			}
+			return 0, 0, fmt.Errorf("unable to move dead letters aside: %w", err)
+		}
+	}
+	pending, err := readDeadLetters(replaying)
+	l.mu.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var kept []Delivery
+	for i := range pending {
+		d := pending[i]
+		if ctx.Err() == nil && deliver(&d) == nil {
+			sent++
+		} else {
+			failed++
+			d.FailedAt = time.Now()
+			kept = append(kept, d)
+		}
+		left := append(append([]Delivery(nil), kept...), pending[i+1:]...)
+		if err := writeDeadLetters(replaying, left); err != nil {
+			return sent, failed, err
+		}
+	}
+
+	// the failures go back ahead of whatever was added in the meantime
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	added, err := readDeadLetters(l.path)
+	if err != nil {
+		return sent, failed, err
+	}
+	if err := writeDeadLetters(l.path, append(kept, added...)); err != nil {
+		return sent, failed, err
+	}
+	if err := os.Remove(replaying); err != nil {
+		return sent, failed, fmt.Errorf("unable to remove replayed dead letters: %w", err)
+	}
+	return sent, failed, ctx.Err()
+}
+
+// writeDeadLetters replaces the file at path with all through a temporary
+// file, so a crash leaves either the old letters or the new ones
+func writeDeadLetters(path string, all []Delivery) error {
+	var content bytes.Buffer
+	for _, d := range all {
+		line, err := json.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("unable to encode dead letter: %w", err)
+		}
+		content.Write(line)
+		content.WriteByte('\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary dead letters file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write dead letters: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to sync dead letters: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close dead letters: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace dead letters: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/voldyman/ssh-chat-notify/mail"
+)
+
+// Email mails notifications through an SMTP server
+type Email struct {
+	cfg mail.Config
+	to  []string
+}
+
+// NewEmail creates an email notifier sending to every address in to
+func NewEmail(cfg mail.Config, to []string) (*Email, error) {
+	if cfg.Host == "" || cfg.From == "" || len(to) == 0 {
+		return nil, errors.New("email needs an smtp host, a from address and at least one recipient")
+	}
+	return &Email{cfg: cfg, to: to}, nil
+}
+
+// Notify sends the mail, ctx's deadline bounds the conversation with the server
+func (e *Email) Notify(ctx context.Context, n Notification) error {
+	msg := mail.Message{To: e.to, Subject: n.Title, Body: n.Text(), Date: n.Time}
+	if err := mail.Send(ctx, e.cfg, msg); err != nil {
+		return fmt.Errorf("unable to send mail: %w", err)
+	}
+	return nil
+}
+
+func (e *Email) String() string {
+	return "email " + strings.Join(e.to, ", ")
+}
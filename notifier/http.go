@@ -0,0 +1,174 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPushoverURL = "https://api.pushover.net/1/messages.json"
+const defaultNtfyURL = "https://ntfy.sh"
+
+// Pushover sends to the Pushover API
+type Pushover struct {
+	Token string
+	User  string
+	// URL is the messages endpoint, it is only changed by tests
+	URL string
+}
+
+// NewPushover creates a Pushover notifier for an application token and a user or group key
+func NewPushover(token, user string) (*Pushover, error) {
+	if token == "" || user == "" {
+		return nil, errors.New("pushover needs a token and a user key")
+	}
+	return &Pushover{Token: token, User: user, URL: defaultPushoverURL}, nil
+}
+
+func (p *Pushover) Notify(ctx context.Context, n Notification) error {
+	params := url.Values{}
+	params.Add("token", p.Token)
+	params.Add("user", p.User)
+	params.Add("title", n.Title)
+	params.Add("message", n.Text())
+	if !n.Time.IsZero() {
+		params.Add("timestamp", strconv.FormatInt(n.Time.Unix(), 10))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return do("pushover", req)
+}
+
+func (p *Pushover) String() string {
+	return "pushover"
+}
+
+// Webhook posts the notification as JSON to any URL
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+}
+
+// webhookPayload is the body a webhook receives
+type webhookPayload struct {
+	Title   string    `json:"title"`
+	From    string    `json:"from"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// NewWebhook creates a webhook notifier, headers are added to every request
+func NewWebhook(target string, headers map[string]string) (*Webhook, error) {
+	if _, err := url.ParseRequestURI(target); err != nil {
+		return nil, errors.New("webhook needs a valid url")
+	}
+	return &Webhook{URL: target, Headers: headers}, nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(webhookPayload{Title: n.Title, From: n.From, Message: n.Message, Time: n.Time})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	return do("webhook", req)
+}
+
+func (w *Webhook) String() string {
+	return "webhook " + w.URL
+}
+
+// Ntfy publishes to a topic on an ntfy server
+type Ntfy struct {
+	Server   string
+	Topic    string
+	Token    string
+	Priority int
+}
+
+// NewNtfy creates an ntfy notifier, an empty server means ntfy.sh and an
+// empty token publishes anonymously
+func NewNtfy(server, topic, token string, priority int) (*Ntfy, error) {
+	if topic == "" {
+		return nil, errors.New("ntfy needs a topic")
+	}
+	if server == "" {
+		server = defaultNtfyURL
+	}
+	return &Ntfy{Server: strings.TrimSuffix(server, "/"), Topic: topic, Token: token, Priority: priority}, nil
+}
+
+func (t *Ntfy) Notify(ctx context.Context, n Notification) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Server+"/"+url.PathEscape(t.Topic), strings.NewReader(n.Text()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title)
+	if t.Priority != 0 {
+		req.Header.Set("Priority", strconv.Itoa(t.Priority))
+	}
+	if t.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	return do("ntfy", req)
+}
+
+func (t *Ntfy) String() string {
+	return "ntfy " + t.Server + "/" + t.Topic
+}
+
+// Gotify sends to a Gotify server with an application token
+type Gotify struct {
+	Server   string
+	Token    string
+	Priority int
+}
+
+type gotifyPayload struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// NewGotify creates a Gotify notifier
+func NewGotify(server, token string, priority int) (*Gotify, error) {
+	if server == "" || token == "" {
+		return nil, errors.New("gotify needs a server url and an application token")
+	}
+	return &Gotify{Server: strings.TrimSuffix(server, "/"), Token: token, Priority: priority}, nil
+}
+
+func (g *Gotify) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(gotifyPayload{Title: n.Title, Message: n.Text(), Priority: g.Priority})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.Server+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", g.Token)
+	return do("gotify", req)
+}
+
+func (g *Gotify) String() string {
+	return "gotify " + g.Server
+}
@@ -0,0 +1,149 @@
+// Package notifier delivers mention alerts to push services, webhooks,
+// email or local commands
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/mail"
+)
+
+// Notification is a mention worth telling someone about
+type Notification struct {
+	Title   string    `json:"title"`
+	From    string    `json:"from"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Text is the notification as one line of prose
+func (n Notification) Text() string {
+	return fmt.Sprintf("%s said: %s", n.From, n.Message)
+}
+
+// Notifier delivers notifications to one destination
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+	// String names the backend and destination for logs
+	String() string
+}
+
+// StatusError is an unexpected HTTP status from a backend
+type StatusError struct {
+	Backend string
+	Code    int
+	Body    string
+	// RetryAfter is how long the backend asked us to wait, zero when it didn't
+	RetryAfter time.Duration
+}
+
+// Temporary reports whether the backend may accept the same request later
+func (e *StatusError) Temporary() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("%s replied with status %d", e.Backend, e.Code)
+	}
+	return fmt.Sprintf("%s replied with status %d: %s", e.Backend, e.Code, e.Body)
+}
+
+// Config selects and configures a backend, which fields matter depends on Type
+type Config struct {
+	// Type is one of pushover, webhook, ntfy, gotify, email or command
+	Type string `mapstructure:"type"`
+
+	// URL is the webhook address or the ntfy or gotify server
+	URL     string            `mapstructure:"url"`
+	Token   string            `mapstructure:"token"`
+	Headers map[string]string `mapstructure:"headers"`
+	// User is the pushover user or group key
+	User     string `mapstructure:"user"`
+	Topic    string `mapstructure:"topic"`
+	Priority int    `mapstructure:"priority"`
+
+	SMTPHost     string   `mapstructure:"smtp-host"`
+	SMTPPort     int      `mapstructure:"smtp-port"`
+	SMTPUsername string   `mapstructure:"smtp-username"`
+	SMTPPassword string   `mapstructure:"smtp-password"`
+	From         string   `mapstructure:"from"`
+	To           []string `mapstructure:"to"`
+
+	// Command is run without a shell, the notification is in its
+	// environment and on its standard input
+	Command []string `mapstructure:"command"`
+}
+
+// New creates the notifier cfg describes
+func New(cfg Config) (Notifier, error) {
+	switch strings.ToLower(cfg.Type) {
+	case "pushover":
+		return NewPushover(cfg.Token, cfg.User)
+	case "webhook":
+		return NewWebhook(cfg.URL, cfg.Headers)
+	case "ntfy":
+		return NewNtfy(cfg.URL, cfg.Topic, cfg.Token, cfg.Priority)
+	case "gotify":
+		return NewGotify(cfg.URL, cfg.Token, cfg.Priority)
+	case "email":
+		return NewEmail(mail.Config{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+		}, cfg.To)
+	case "command":
+		return NewCommand(cfg.Command)
+	}
+	return nil, fmt.Errorf("unknown notifier type '%s'", cfg.Type)
+}
+
+// httpClient is shared by the HTTP backends, callers set deadlines through
+// the context
+var httpClient = &http.Client{}
+
+// do sends req and turns any status outside 2xx into a StatusError
+func do(backend string, req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach %s: %w", backend, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return &StatusError{
+			Backend:    backend,
+			Code:       resp.StatusCode,
+			Body:       strings.TrimSpace(string(body)),
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// retryAfter reads a Retry-After header in either of its forms
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,238 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/testutil"
+)
+
+var mention = Notification{
+	Title:   "SSH Chat Mention",
+	From:    "alice",
+	Message: "ping voldyman",
+	Time:    time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC),
+}
+
+// capture starts a server that records the last request and replies with status
+func capture(t *testing.T, status int) (*httptest.Server, func() (*http.Request, string)) {
+	var last *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		last, body = r, string(content)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() (*http.Request, string) { return last, body }
+}
+
+func notify(t *testing.T, n Notifier) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Notify(ctx, mention); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushover(t *testing.T) {
+	srv, last := capture(t, http.StatusOK)
+	p, err := NewPushover("app", "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.URL = srv.URL
+	notify(t, p)
+
+	_, body := last()
+	form, err := url.ParseQuery(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"token":     "app",
+		"user":      "group",
+		"title":     "SSH Chat Mention",
+		"message":   "alice said: ping voldyman",
+		"timestamp": strconv.FormatInt(mention.Time.Unix(), 10),
+	}
+	for k, v := range want {
+		if got := form.Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	srv, last := capture(t, http.StatusNoContent)
+	w, err := NewWebhook(srv.URL+"/hook", map[string]string{"Authorization": "Bearer s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify(t, w)
+
+	req, body := last()
+	if req.URL.Path != "/hook" || req.Header.Get("Authorization") != "Bearer s3cret" {
+		t.Errorf("unexpected request %s %v", req.URL, req.Header)
+	}
+	var got webhookPayload
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.From != "alice" || got.Message != "ping voldyman" || !got.Time.Equal(mention.Time) {
+		t.Errorf("unexpected payload %+v", got)
+	}
+}
+
+func TestNtfy(t *testing.T) {
+	srv, last := capture(t, http.StatusOK)
+	n, err := NewNtfy(srv.URL+"/", "mentions", "tk", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify(t, n)
+
+	req, body := last()
+	if req.URL.Path != "/mentions" {
+		t.Errorf("published to %s", req.URL.Path)
+	}
+	if body != "alice said: ping voldyman" {
+		t.Errorf("body = %q", body)
+	}
+	if req.Header.Get("Title") != "SSH Chat Mention" || req.Header.Get("Priority") != "4" ||
+		req.Header.Get("Authorization") != "Bearer tk" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+}
+
+func TestGotify(t *testing.T) {
+	srv, last := capture(t, http.StatusOK)
+	g, err := NewGotify(srv.URL, "app-token", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify(t, g)
+
+	req, body := last()
+	if req.URL.Path != "/message" || req.Header.Get("X-Gotify-Key") != "app-token" {
+		t.Errorf("unexpected request %s %v", req.URL, req.Header)
+	}
+	var got gotifyPayload
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := gotifyPayload{Title: "SSH Chat Mention", Message: "alice said: ping voldyman", Priority: 5}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	w, err := NewWebhook(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Notify(context.Background(), mention)
+	var status *StatusError
+	if !errors.As(err, &status) {
+		t.Fatalf("expected a StatusError, got %v", err)
+	}
+	if status.Code != http.StatusTooManyRequests || status.Body != "slow down" {
+		t.Errorf("unexpected error %+v", status)
+	}
+}
+
+func TestEmail(t *testing.T) {
+	server, err := testutil.NewSMTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Addr())
+	portNum, _ := strconv.Atoi(port)
+
+	e, err := New(Config{
+		Type:     "email",
+		SMTPHost: host,
+		SMTPPort: portNum,
+		From:     "otear@example.com",
+		To:       []string{"voldy@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify(t, e)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mail, err := server.WaitForMail(ctx, "voldy@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(mail.Data, "Subject: SSH Chat Mention") ||
+		!strings.Contains(mail.Data, "alice said: ping voldyman") {
+		t.Errorf("unexpected mail:\n%s", mail.Data)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	c, err := NewCommand([]string{"sh", "-c", `echo "$NOTIFY_FROM|$NOTIFY_MESSAGE" > "$0"; cat >> "$0"`, out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify(t, c)
+
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "alice|ping voldyman\nalice said: ping voldyman\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCommandFailureIncludesOutput(t *testing.T) {
+	c, err := NewCommand([]string{"sh", "-c", "echo no display >&2; exit 3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Notify(context.Background(), mention)
+	if err == nil || !strings.Contains(err.Error(), "no display") {
+		t.Errorf("expected the command's output in the error, got %v", err)
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	bad := []Config{
+		{Type: "carrier-pigeon"},
+		{Type: "pushover", Token: "app"},
+		{Type: "webhook", URL: "not a url"},
+		{Type: "ntfy"},
+		{Type: "gotify", URL: "http://localhost"},
+		{Type: "email", SMTPHost: "localhost", From: "a@example.com"},
+		{Type: "command"},
+	}
+	for _, cfg := range bad {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
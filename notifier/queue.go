@@ -0,0 +1,251 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Enqueue when every slot is taken, the delivery
+// goes to the dead letters instead
+var ErrQueueFull = errors.New("notification queue is full")
+
+// ErrQueueClosed is returned by Enqueue after Close
+var ErrQueueClosed = errors.New("notification queue is closed")
+
+// Delivery is a notification on its way to one backend. Only the mention
+// and the backend's position among its notifiers are written to the dead
+// letters, the backend's config holds credentials and is looked up again
+// when a dead letter is replayed.
+type Delivery struct {
+	Mention string `json:"mention"`
+	// Notifier is the backend's index in the mention's notifiers and Type
+	// its type, replay checks both before trusting the current config
+	Notifier     int          `json:"notifier"`
+	Type         string       `json:"type"`
+	Config       Config       `json:"-"`
+	Notification Notification `json:"notification"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error,omitempty"`
+	FailedAt     time.Time    `json:"failed-at,omitempty"`
+}
+
+// RetryPolicy is how hard a delivery is tried before it is given up on
+type RetryPolicy struct {
+	// Timeout bounds each attempt, zero means 10s
+	Timeout time.Duration
+	// MaxAttempts caps the attempts per delivery, zero means 5
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles with every
+	// retry up to MaxBackoff. Zero means 2s and 2m.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// OnError, when set, hears about every failed attempt
+	OnError func(d Delivery, err error, retrying bool)
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Timeout <= 0 {
+		p.Timeout = 10 * time.Second
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = 2 * time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 2 * time.Minute
+	}
+	return p
+}
+
+// Deliver sends d, retrying temporary failures. Attempts and Error on d are
+// updated as it goes.
+func (p RetryPolicy) Deliver(ctx context.Context, d *Delivery) error {
+	p = p.withDefaults()
+	n, err := New(d.Config)
+	if err != nil {
+		d.Error = err.Error()
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		d.Attempts++
+		attemptCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+		err := n.Notify(attemptCtx, d.Notification)
+		cancel()
+		if err == nil {
+			d.Error = ""
+			return nil
+		}
+		d.Error = err.Error()
+
+		retrying := attempt < p.MaxAttempts && Retryable(err) && ctx.Err() == nil
+		if p.OnError != nil {
+			p.OnError(*d, err, retrying)
+		}
+		if !retrying {
+			return err
+		}
+
+		timer := time.NewTimer(p.backoff(attempt, err))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int, err error) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	var status *StatusError
+	if errors.As(err, &status) && status.RetryAfter > wait {
+		wait = status.RetryAfter
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// Retryable reports whether err may go away on its own: 5xx and 429
+// replies, timeouts, network trouble and 4xx SMTP replies. Every backend
+// ends its exchange by the attempt's deadline, so retrying after a timeout
+// never leaves the previous attempt running.
+func Retryable(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Temporary()
+	}
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 400 && smtpErr.Code < 500
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// QueueConfig sizes a Queue
+type QueueConfig struct {
+	RetryPolicy
+	// Workers is how many deliveries run at once, zero means 4
+	Workers int
+	// Size is how many deliveries can wait for a worker, zero means 256
+	Size int
+	// DeadLetters keeps deliveries that ran out of attempts, nil drops them
+	DeadLetters *DeadLetters
+}
+
+// Queue delivers notifications in the background so slow backends don't
+// hold up whoever is producing them
+type Queue struct {
+	cfg QueueConfig
+
+	mu     sync.RWMutex
+	closed bool
+	jobs   chan Delivery
+
+	// ctx is cancelled when Close gives up waiting, workers then dead-letter
+	// whatever they hold
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// NewQueue starts a queue's workers
+func NewQueue(cfg QueueConfig) *Queue {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = 256
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	q := &Queue{cfg: cfg, jobs: make(chan Delivery, cfg.Size), ctx: ctx, stop: stop}
+	for i := 0; i < cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue hands d to the workers without waiting for it
+func (q *Queue) Enqueue(d Delivery) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case q.jobs <- d:
+		return nil
+	default:
+		q.bury(d, ErrQueueFull)
+		return ErrQueueFull
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for d := range q.jobs {
+		if err := q.ctx.Err(); err != nil {
+			q.bury(d, err)
+			continue
+		}
+		if err := q.cfg.Deliver(q.ctx, &d); err != nil {
+			q.bury(d, err)
+		}
+	}
+}
+
+// bury records a delivery that won't be tried again
+func (q *Queue) bury(d Delivery, err error) {
+	if q.cfg.DeadLetters == nil {
+		return
+	}
+	d.Error = err.Error()
+	d.FailedAt = time.Now()
+	if addErr := q.cfg.DeadLetters.Add(d); addErr != nil && q.cfg.OnError != nil {
+		q.cfg.OnError(d, addErr, false)
+	}
+}
+
+// Close stops taking deliveries and waits for the queued ones. When ctx ends
+// first the rest are dead-lettered and ctx's error is returned.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.stop()
+		return nil
+	case <-ctx.Done():
+		q.stop()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,315 @@
+package notifier
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flaky replies with the statuses in turn and 200 once they run out
+func flaky(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		if int(n) <= len(statuses) {
+			w.WriteHeader(statuses[n-1])
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func fastPolicy() RetryPolicy {
+	return RetryPolicy{Timeout: time.Second, MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+}
+
+func runQueue(t *testing.T, url string) *DeadLetters {
+	dead := NewDeadLetters(filepath.Join(t.TempDir(), "dead.jsonl"))
+	q := NewQueue(QueueConfig{RetryPolicy: fastPolicy(), Workers: 2, DeadLetters: dead})
+	err := q.Enqueue(Delivery{Mention: "voldy", Config: Config{Type: "webhook", URL: url}, Notification: mention})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return dead
+}
+
+func deadLetters(t *testing.T, dead *DeadLetters) []Delivery {
+	all, err := dead.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+func TestQueueRetriesTemporaryFailures(t *testing.T) {
+	srv, hits := flaky(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	dead := runQueue(t, srv.URL)
+
+	if got := atomic.LoadInt32(hits); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+	if got := deadLetters(t, dead); len(got) != 0 {
+		t.Errorf("expected no dead letters, got %+v", got)
+	}
+}
+
+func TestQueueDeadLettersPermanentFailures(t *testing.T) {
+	srv, hits := flaky(t, http.StatusBadRequest)
+	dead := runQueue(t, srv.URL)
+
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Errorf("a 400 should not be retried, got %d attempts", got)
+	}
+	got := deadLetters(t, dead)
+	if len(got) != 1 {
+		t.Fatalf("expected one dead letter, got %+v", got)
+	}
+	if got[0].Mention != "voldy" || got[0].Notification.Message != "ping voldyman" ||
+		got[0].Attempts != 1 || got[0].Error == "" || got[0].FailedAt.IsZero() {
+		t.Errorf("unexpected dead letter %+v", got[0])
+	}
+}
+
+func TestQueueGivesUpAfterMaxAttempts(t *testing.T) {
+	srv, hits := flaky(t, 500, 502, 503, 504)
+	dead := runQueue(t, srv.URL)
+
+	if got := atomic.LoadInt32(hits); got != 3 {
+		t.Errorf("expected 3 attempts, got %d", got)
+	}
+	if got := deadLetters(t, dead); len(got) != 1 || got[0].Attempts != 3 {
+		t.Errorf("expected one dead letter after 3 attempts, got %+v", got)
+	}
+}
+
+func TestQueueTimesOutSlowBackends(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	policy := fastPolicy()
+	policy.Timeout = 20 * time.Millisecond
+	policy.MaxAttempts = 2
+	d := Delivery{Config: Config{Type: "webhook", URL: srv.URL}, Notification: mention}
+
+	start := time.Now()
+	if err := policy.Deliver(context.Background(), &d); err == nil {
+		t.Fatal("expected the delivery to time out")
+	}
+	if d.Attempts != 2 {
+		t.Errorf("timeouts should be retried, got %d attempts", d.Attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("delivery took %s", elapsed)
+	}
+}
+
+func TestTimedOutMailIsHungUpBeforeRetrying(t *testing.T) {
+	// a server that never greets, it reports when the client hangs up
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	hungUp := make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+				hungUp <- struct{}{}
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	policy := fastPolicy()
+	policy.Timeout = 50 * time.Millisecond
+	policy.MaxAttempts = 2
+	d := Delivery{
+		Config:       Config{Type: "email", SMTPHost: host, SMTPPort: portNum, From: "otear@example.com", To: []string{"voldy@example.com"}},
+		Notification: mention,
+	}
+	if err := policy.Deliver(context.Background(), &d); err == nil || d.Attempts != 2 {
+		t.Fatalf("expected two timed out attempts, got %d: %v", d.Attempts, err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-hungUp:
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d is still talking to the server", i+1)
+		}
+	}
+}
+
+func TestEnqueueWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+
+	dead := NewDeadLetters(filepath.Join(t.TempDir(), "dead.jsonl"))
+	q := NewQueue(QueueConfig{RetryPolicy: fastPolicy(), Workers: 1, Size: 1, DeadLetters: dead})
+	d := Delivery{Config: Config{Type: "webhook", URL: srv.URL}, Notification: mention}
+
+	// the first is picked up by the worker, the second waits in the queue
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = q.Enqueue(d)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	close(block)
+	q.Close(context.Background())
+
+	if got := deadLetters(t, dead); len(got) != 1 {
+		t.Errorf("expected the rejected delivery to be dead-lettered, got %+v", got)
+	}
+	if err := q.Enqueue(d); err != ErrQueueClosed {
+		t.Errorf("expected ErrQueueClosed, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	cases := []struct {
+		attempt int
+		err     error
+		want    time.Duration
+	}{
+		{1, nil, time.Second},
+		{2, nil, 2 * time.Second},
+		{3, nil, 4 * time.Second},
+		{4, nil, 5 * time.Second},
+		{1, &StatusError{Code: 429, RetryAfter: 3 * time.Second}, 3 * time.Second},
+		{1, &StatusError{Code: 429, RetryAfter: time.Hour}, 5 * time.Second},
+	}
+	for _, c := range cases {
+		if got := p.backoff(c.attempt, c.err); got != c.want {
+			t.Errorf("backoff(%d, %v) = %s, want %s", c.attempt, c.err, got, c.want)
+		}
+	}
+}
+
+// replayTo resolves dead letters against backends the way otear resolves
+// them against its mentions
+func replayTo(ctx context.Context, backends []Config) func(*Delivery) error {
+	return func(d *Delivery) error {
+		d.Config = backends[d.Notifier]
+		return fastPolicy().Deliver(ctx, d)
+	}
+}
+
+func TestReplayKeepsFailures(t *testing.T) {
+	ok, _ := flaky(t)
+	broken, _ := flaky(t, 400, 400)
+	backends := []Config{{Type: "webhook", URL: ok.URL}, {Type: "webhook", URL: broken.URL}}
+
+	dead := NewDeadLetters(filepath.Join(t.TempDir(), "dead.jsonl"))
+	for i, cfg := range backends {
+		if err := dead.Add(Delivery{Notifier: i, Type: cfg.Type, Config: cfg, Notification: mention}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	sent, failed, err := dead.Replay(ctx, replayTo(ctx, backends))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || failed != 1 {
+		t.Errorf("sent %d and failed %d, want 1 and 1", sent, failed)
+	}
+	left := deadLetters(t, dead)
+	if len(left) != 1 || left[0].Notifier != 1 || left[0].Attempts != 1 {
+		t.Errorf("expected only the broken delivery to remain, got %+v", left)
+	}
+}
+
+func TestDeadLettersLeaveOutConfig(t *testing.T) {
+	dead := NewDeadLetters(filepath.Join(t.TempDir(), "dead.jsonl"))
+	d := Delivery{Mention: "voldy", Type: "pushover", Config: Config{Type: "pushover", Token: "secret-token"}, Notification: mention}
+	if err := dead.Add(d); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(dead.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "secret-token") {
+		t.Fatalf("dead letter holds the backend's credentials: %s", content)
+	}
+}
+
+func TestInterruptedReplayDoesNotResend(t *testing.T) {
+	srv, hits := flaky(t)
+	backends := []Config{{Type: "webhook", URL: srv.URL}}
+	dead := NewDeadLetters(filepath.Join(t.TempDir(), "dead.jsonl"))
+	for i := 0; i < 3; i++ {
+		if err := dead.Add(Delivery{Type: "webhook", Notification: mention}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the replay dies while sending the second letter
+	ctx := context.Background()
+	deliver := replayTo(ctx, backends)
+	delivered := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dead.Replay(ctx, func(d *Delivery) error {
+			if delivered++; delivered == 2 {
+				runtime.Goexit()
+			}
+			return deliver(d)
+		})
+	}()
+	<-done
+	if _, err := os.Stat(dead.Path() + ".replaying"); err != nil {
+		t.Fatal("expected the interrupted replay to be left to pick up:", err)
+	}
+	if got := deadLetters(t, dead); len(got) != 2 {
+		t.Fatalf("expected the two letters that weren't sent, got %+v", got)
+	}
+
+	sent, failed, err := dead.Replay(ctx, deliver)
+	if err != nil || sent != 2 || failed != 0 {
+		t.Fatalf("sent %d and failed %d: %v", sent, failed, err)
+	}
+	if got := atomic.LoadInt32(hits); got != 3 {
+		t.Errorf("expected each letter to be sent once, got %d sends", got)
+	}
+	if got := deadLetters(t, dead); len(got) != 0 {
+		t.Errorf("expected no dead letters, got %+v", got)
+	}
+}
@@ -1,49 +1,165 @@
 package notifyi
 
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/archive"
+	"github.com/voldyman/ssh-chat-notify/match"
+)
+
 type Comms interface {
 	PrivateMessage(toUsername, message string) error
 	PublicMessage(message string) error
+	// Notification is a PM nobody is waiting for, replies to commands may overtake it
+	Notification(toUsername, message string) error
 }
 
 type Bot struct {
-	name  string
-	comms Comms
+	name    string
+	comms   Comms
+	mailer  Mailer
+	onError func(error)
+	archive *archive.Archive
+	now     func() time.Time
+
+	// mu serializes read-modify-write sequences on the store and guards
+	// the watch index kept alongside it
+	mu           sync.Mutex
+	store        Store
+	watchSet     *match.Set
+	nickWatchers map[string]bool
+
+	mailWG    sync.WaitGroup
+	mailSlots chan struct{}
+
+	// sessionMu guards the roster, the nick to fingerprint cache and the
+	// /whois bookkeeping
+	sessionMu sync.Mutex
+	roster    map[string]member
+	sessions  map[string]string
+	waiting   map[string]*whoisWait
+	whoisName string
+}
+
+// Option configures optional parts of the bot
+type Option func(*Bot)
+
+// WithMailer lets the bot send verification codes and notifications by email
+func WithMailer(mailer Mailer) Option {
+	return func(b *Bot) {
+		b.mailer = mailer
+	}
+}
+
+// WithErrorHandler reports errors from work the bot does in the
+// background, like mailing notifications
+func WithErrorHandler(fn func(error)) Option {
+	return func(b *Bot) {
+		b.onError = fn
+	}
+}
+
+// WithArchive lets users search the room's archive
+func WithArchive(a *archive.Archive) Option {
+	return func(b *Bot) {
+		b.archive = a
+	}
 }
 
-func New(name string, comms Comms) *Bot {
-	return &Bot{
+// WithStore keeps the bot's users and watches in store instead of in memory
+func WithStore(store Store) Option {
+	return func(b *Bot) {
+		b.store = store
+	}
+}
+
+func New(name string, comms Comms, opts ...Option) *Bot {
+	b := &Bot{
 		name:  name,
 		comms: comms,
+		now:   time.Now,
+		store: NewMemoryStore(),
+
+		roster:   map[string]member{},
+		sessions: map[string]string{},
+		waiting:  map[string]*whoisWait{},
+
+		mailSlots: make(chan struct{}, maxMailers),
+	}
+	for _, opt := range opts {
+		opt(b)
 	}
+	return b
 }
 
 func (b *Bot) PublicMessage(username, message string) error {
-	return nil
+	if err := b.record(HistoryPublic, username, message); err != nil {
+		return err
+	}
+	return b.notifyWatchers(username, message, fmt.Sprintf("%s: %s", username, message))
 }
 
 func (b *Bot) PrivateMessage(username, message string) error {
-	cmd := parsePrivateMessage(message)
+	cmd, spec, err := b.parsePrivateMessage(sender{nick: username}, message)
+	if err != nil {
+		return b.comms.PrivateMessage(username, err.Error())
+	}
 	if cmd == nil {
-		//b.comms.PrivateMessage(username, "i am still a WIP, talk to voldyman if you want to know more")
 		return b.sendHelp(username)
 	}
-	return nil
+	if spec.anonymous {
+		return cmd.Execute(b.comms)
+	}
+
+	return b.withAccount(username, func(nick, fingerprint string) error {
+		if fingerprint == "" {
+			return b.comms.PrivateMessage(nick, errNoPublicKey.Error())
+		}
+		from := sender{nick: nick, account: fingerprint}
+		cmd, _, err := b.parsePrivateMessage(from, message)
+		if err != nil {
+			return err
+		}
+		if err := b.seen(nick, fingerprint); err != nil {
+			return err
+		}
+		return cmd.Execute(b.comms)
+	})
 }
 
 func (b *Bot) ActionMessage(username, action string) error {
-	return nil
+	if err := b.record(HistoryAction, username, action); err != nil {
+		return err
+	}
+	return b.notifyWatchers(username, action, fmt.Sprintf("** %s %s", username, action))
 }
 
 func (b *Bot) UserJoinedMessage(username string) error {
-	return nil
+	b.forget(username)
+	b.joined(username)
+	if err := b.record(HistoryJoin, username, ""); err != nil {
+		return err
+	}
+	return b.deliverNotes(username)
 }
 
 func (b *Bot) UserLeftMessage(username string) error {
-	return nil
+	err := b.recordLeft(username)
+	b.forget(username)
+	b.left(username)
+	if err != nil {
+		return err
+	}
+	return b.record(HistoryLeft, username, "")
 }
 
 func (b *Bot) UsernameChangeMessage(from, to string) error {
-	return nil
+	if err := b.rename(from, to); err != nil {
+		return err
+	}
+	return b.deliverNotes(to)
 }
 
 func (b *Bot) sendHelp(username string) error {
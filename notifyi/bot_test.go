@@ -0,0 +1,253 @@
+package notifyi
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/client"
+	"github.com/voldyman/ssh-chat-notify/parser"
+	"github.com/voldyman/ssh-chat-notify/testutil"
+)
+
+const botName = "notifyi"
+
+type clientComms struct {
+	ctx    context.Context
+	client *client.Client
+}
+
+func (c *clientComms) PrivateMessage(toUsername, message string) error {
+	return c.send(fmt.Sprintf("/msg %s %s", toUsername, message))
+}
+
+func (c *clientComms) Notification(toUsername, message string) error {
+	return c.PrivateMessage(toUsername, message)
+}
+
+func (c *clientComms) PublicMessage(message string) error {
+	return c.send(message)
+}
+
+func (c *clientComms) send(line string) error {
+	delivery, err := c.client.Send(c.ctx, line)
+	if err != nil {
+		return err
+	}
+	return delivery.Wait(c.ctx)
+}
+
+// startBot connects a bot to a fresh fake ssh-chat and feeds it the room
+func startBot(ctx context.Context, t *testing.T) *testutil.ChatServer {
+	server, err := testutil.NewChatServer()
+	if err != nil {
+		t.Fatal("unable to start chat server:", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	dir := t.TempDir()
+	c, err := client.CreateClient(server.Addr(), botName,
+		client.WithKnownHosts(filepath.Join(dir, "known_hosts")),
+		client.WithAuth(client.Identity(filepath.Join(dir, "id_ed25519"))),
+		client.WithKeepalive(0, 0))
+	if err != nil {
+		t.Fatal("unable to connect:", err)
+	}
+
+	bot := New(botName, &clientComms{ctx: ctx, client: c})
+	events := make(chan client.Event, 64)
+	go c.Run(ctx, events)
+	go func() {
+		for event := range events {
+			switch msg := event.Msg.(type) {
+			case parser.PrivateMsg:
+				bot.PrivateMessage(msg.From, msg.Message)
+			case parser.PublicMsg:
+				bot.PublicMessage(msg.From, msg.Message)
+			case parser.ActionMsg:
+				bot.ActionMessage(msg.From, msg.Message)
+			case parser.UsernameChangeMsg:
+				bot.UsernameChangeMessage(msg.FromUsername, msg.ToUsername)
+			case parser.JoinMsg:
+				if msg.Status == parser.UserJoined {
+					bot.UserJoinedMessage(msg.Username)
+				} else {
+					bot.UserLeftMessage(msg.Username)
+				}
+			case parser.AwayMsg:
+				bot.AwayMessage(msg.Username, msg.Away)
+			case parser.NamesMsg:
+				bot.NamesMessage(msg.Names)
+			case parser.WhoisMsg:
+				bot.WhoisMessage(msg.Field, msg.Value)
+			}
+		}
+	}()
+	if err := bot.Connected(); err != nil {
+		t.Fatal("unable to ask for names:", err)
+	}
+
+	if err := server.WaitForConnection(ctx, botName); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestUnknownCommandGetsHelp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := startBot(ctx, t)
+
+	server.Join("alice")
+	server.PrivateMessage("alice", botName, "hello there")
+
+	_, err := server.WaitFor(ctx, func(r testutil.Received) bool {
+		return r.From == botName && strings.HasPrefix(r.Line, "/msg alice ") && strings.Contains(r.Line, helpCmdName)
+	})
+	if err != nil {
+		t.Fatal("bot never replied with help:", err)
+	}
+}
+
+func TestWatchNotifiesOwner(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := startBot(ctx, t)
+
+	server.Join("alice")
+	server.Join("bob")
+	server.PrivateMessage("alice", botName, `add-watch "release train"`)
+	_, err := server.WaitFor(ctx, func(r testutil.Received) bool {
+		return r.Line == "/msg alice watching for 'release train'"
+	})
+	if err != nil {
+		t.Fatal("watch was not confirmed:", err)
+	}
+
+	server.Say("bob", "the Release Train leaves at noon")
+	_, err = server.WaitFor(ctx, func(r testutil.Received) bool {
+		return strings.HasPrefix(r.Line, "/msg alice ") && strings.Contains(r.Line, "bob: the Release Train leaves at noon")
+	})
+	if err != nil {
+		t.Fatal("alice was not notified:", err)
+	}
+}
+
+func TestImpersonatorCannotSeeWatches(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := startBot(ctx, t)
+
+	server.Join("alice")
+	server.PrivateMessage("alice", botName, "add-watch deploy")
+	_, err := server.WaitFor(ctx, func(r testutil.Received) bool {
+		return r.Line == "/msg alice watching for 'deploy'"
+	})
+	if err != nil {
+		t.Fatal("watch was not confirmed:", err)
+	}
+
+	server.Leave("alice")
+	server.Join("mallory")
+	server.Rename("mallory", "alice")
+	server.PrivateMessage("alice", botName, "list-watches")
+	_, err = server.WaitFor(ctx, func(r testutil.Received) bool {
+		return r.Line == "/msg alice you are not watching anything"
+	})
+	if err != nil {
+		t.Fatalf("impersonator got alice's watches: %v\n%+v", err, server.Received())
+	}
+
+	server.Say("bob", "deploy is done")
+	quiet, cancelQuiet := context.WithTimeout(ctx, time.Second)
+	defer cancelQuiet()
+	_, err = server.WaitFor(quiet, func(r testutil.Received) bool {
+		return strings.Contains(r.Line, "bob: deploy is done")
+	})
+	if err == nil {
+		t.Fatal("the impersonator was notified about alice's watch")
+	}
+}
+
+func TestNickWatchFollowsRenames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := startBot(ctx, t)
+
+	server.Join("alice")
+	server.Join("bob")
+	server.PrivateMessage("alice", botName, "add-watch $nick")
+	_, err := server.WaitFor(ctx, func(r testutil.Received) bool {
+		return strings.HasPrefix(r.Line, "/msg alice watching for your nick")
+	})
+	if err != nil {
+		t.Fatal("watch was not confirmed:", err)
+	}
+
+	server.Rename("alice", "ally")
+	server.Say("bob", "alice is gone, ask ally")
+	_, err = server.WaitFor(ctx, func(r testutil.Received) bool {
+		return strings.HasPrefix(r.Line, "/msg ally ") && strings.Contains(r.Line, "ask ally")
+	})
+	if err != nil {
+		t.Fatal("ally was not notified under the new nick:", err)
+	}
+}
+
+func TestAwayModeWaitsUntilAway(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := startBot(ctx, t)
+
+	server.Join("alice")
+	server.Join("bob")
+	server.PrivateMessage("alice", botName, "add-watch deploy")
+	server.PrivateMessage("alice", botName, "notify-when away")
+	_, err := server.WaitFor(ctx, func(r testutil.Received) bool {
+		return strings.HasPrefix(r.Line, "/msg alice you will only be notified while you are away")
+	})
+	if err != nil {
+		t.Fatal("mode was not confirmed:", err)
+	}
+
+	server.Say("bob", "deploy one")
+	server.Away("alice", "lunch")
+	server.Say("bob", "deploy two")
+	_, err = server.WaitFor(ctx, func(r testutil.Received) bool {
+		return strings.HasPrefix(r.Line, "/msg alice ") && strings.Contains(r.Line, "deploy two")
+	})
+	if err != nil {
+		t.Fatal("alice was not notified while away:", err)
+	}
+	for _, r := range server.Received() {
+		if strings.Contains(r.Line, "deploy one") {
+			t.Fatal("alice was notified while active:", r.Line)
+		}
+	}
+}
+
+func TestTellDeliversOnJoin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	server := startBot(ctx, t)
+
+	server.Join("bob")
+	server.PrivateMessage("bob", botName, "tell carol the build is green")
+	_, err := server.WaitFor(ctx, func(r testutil.Received) bool {
+		return strings.HasPrefix(r.Line, "/msg bob carol will get your note")
+	})
+	if err != nil {
+		t.Fatal("note was not accepted:", err)
+	}
+
+	server.Join("carol")
+	_, err = server.WaitFor(ctx, func(r testutil.Received) bool {
+		return r.Line == "/msg carol note from bob, just now: the build is green"
+	})
+	if err != nil {
+		t.Fatal("carol never got the note:", err)
+	}
+}
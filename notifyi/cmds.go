@@ -1,32 +1,198 @@
 package notifyi
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const helpCmdName = "help"
 const registerCmdName = "register"
 const verifyCmdName = "verify"
 const addWatchCmdName = "add-watch"
 const stopWatchCmdName = "stop-watch"
+const listWatchesCmdName = "list-watches"
+const notifyWhenCmdName = "notify-when"
+const tellCmdName = "tell"
+const missedCmdName = "missed"
+const searchCmdName = "search"
 
 type executableCmd interface {
 	Execute(responder Comms) error
 }
 
+// commandSpec describes a command for the dispatcher and the help text
+type commandSpec struct {
+	name    string
+	args    string
+	minArgs int
+	maxArgs int
+	// anonymous commands run without looking up the sender's key
+	anonymous bool
+	// rest makes the last argument everything after the others, as typed
+	rest  bool
+	build func(b *Bot, from sender, args []string) (executableCmd, error)
+}
+
+func (c commandSpec) usage(myusername string) string {
+	if c.args == "" {
+		return fmt.Sprintf("/msg %s %s", myusername, c.name)
+	}
+	return fmt.Sprintf("/msg %s %s %s", myusername, c.name, c.args)
+}
+
+// commands is the registry of everything the bot understands, in the order
+// the help text lists them
+var commands []commandSpec
+
+func init() {
+	commands = []commandSpec{
+		{
+			name:      helpCmdName,
+			anonymous: true,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				return &helpCmd{myusername: b.name, sendTo: from.nick}, nil
+			},
+		},
+		{
+			name:    registerCmdName,
+			args:    "<email>",
+			minArgs: 1,
+			maxArgs: 1,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				if !looksLikeEmail(args[0]) {
+					return nil, fmt.Errorf("'%s' is not an email address", args[0])
+				}
+				return &registerCmd{bot: b, sendTo: from.nick, account: from.account, email: args[0]}, nil
+			},
+		},
+		{
+			name:    verifyCmdName,
+			args:    "<email> <verification code>",
+			minArgs: 2,
+			maxArgs: 2,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				if !looksLikeEmail(args[0]) {
+					return nil, fmt.Errorf("'%s' is not an email address", args[0])
+				}
+				return &verifyCmd{bot: b, sendTo: from.nick, account: from.account, email: args[0], code: args[1]}, nil
+			},
+		},
+		{
+			name:    addWatchCmdName,
+			args:    "<token>",
+			minArgs: 1,
+			maxArgs: 1,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				return &addWatchCmd{bot: b, sendTo: from.nick, account: from.account, token: args[0]}, nil
+			},
+		},
+		{
+			name:    stopWatchCmdName,
+			args:    "<token>",
+			minArgs: 1,
+			maxArgs: 1,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				return &stopWatchCmd{bot: b, sendTo: from.nick, account: from.account, token: args[0]}, nil
+			},
+		},
+		{
+			name: listWatchesCmdName,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				return &listWatchesCmd{bot: b, sendTo: from.nick, account: from.account}, nil
+			},
+		},
+		{
+			name:    notifyWhenCmdName,
+			args:    "<always|offline|away>",
+			minArgs: 1,
+			maxArgs: 1,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				mode, err := parseNotifyMode(args[0])
+				if err != nil {
+					return nil, err
+				}
+				return &notifyWhenCmd{bot: b, sendTo: from.nick, account: from.account, mode: mode}, nil
+			},
+		},
+		{
+			name:    missedCmdName,
+			args:    "[lines|duration]",
+			maxArgs: 1,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				var req replayRequest
+				if len(args) == 1 {
+					var err error
+					if req, err = parseReplayRequest(args[0]); err != nil {
+						return nil, err
+					}
+				}
+				return &missedCmd{bot: b, sendTo: from.nick, account: from.account, req: req}, nil
+			},
+		},
+		{
+			name:      searchCmdName,
+			args:      "<terms>",
+			minArgs:   1,
+			maxArgs:   1,
+			anonymous: true,
+			rest:      true,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				return &searchCmd{bot: b, sendTo: from.nick, terms: args[0]}, nil
+			},
+		},
+		{
+			name:    tellCmdName,
+			args:    "<nick|fingerprint> <message>",
+			minArgs: 2,
+			maxArgs: 2,
+			rest:    true,
+			build: func(b *Bot, from sender, args []string) (executableCmd, error) {
+				if len(args[1]) > maxNoteLength {
+					return nil, fmt.Errorf("notes can be at most %d characters", maxNoteLength)
+				}
+				return &tellCmd{bot: b, sendTo: from.nick, account: from.account, to: args[0], message: args[1]}, nil
+			},
+		},
+	}
+}
+
+func lookupCommand(name string) (commandSpec, bool) {
+	for _, spec := range commands {
+		if spec.name == strings.ToLower(name) {
+			return spec, true
+		}
+	}
+	return commandSpec{}, false
+}
+
+func looksLikeEmail(s string) bool {
+	at := strings.LastIndex(s, "@")
+	return at > 0 && at < len(s)-1 && !strings.ContainsAny(s, " <>")
+}
+
+// usageError is sent back to the user when a command was called wrong
+type usageError struct {
+	myusername string
+	spec       commandSpec
+	reason     string
+}
+
+func (u *usageError) Error() string {
+	usage := "usage: " + u.spec.usage(u.myusername)
+	if u.reason == "" {
+		return usage
+	}
+	return u.reason + ", " + usage
+}
+
 type helpCmd struct {
 	myusername string
 	sendTo     string
 }
 
 func (h *helpCmd) Execute(comms Comms) error {
-	helpMessage := []string{
-		fmt.Sprintf("/msg %s %s", h.myusername, helpCmdName),
-		fmt.Sprintf("/msg %s %s <email>", h.myusername, registerCmdName),
-		fmt.Sprintf("/msg %s %s <email> <verification code>", h.myusername, verifyCmdName),
-		fmt.Sprintf("/msg %s %s <token>", h.myusername, addWatchCmdName),
-		fmt.Sprintf("/msg %s %s <token>", h.myusername, stopWatchCmdName),
-	}
-	for _, msg := range helpMessage {
-		err := comms.PrivateMessage(h.sendTo, msg)
+	for _, spec := range commands {
+		err := comms.PrivateMessage(h.sendTo, spec.usage(h.myusername))
 		if err != nil {
 			return fmt.Errorf("unable to send help to user %s: %w", h.sendTo, err)
 		}
@@ -34,7 +200,191 @@ func (h *helpCmd) Execute(comms Comms) error {
 	return nil
 }
 
-type registerCmd struct{}
-type verifyCmd struct{}
-type addWatchCmd struct{}
-type stopWatchCmd struct{}
+type registerCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	email   string
+}
+
+func (r *registerCmd) Execute(comms Comms) error {
+	err := r.bot.startRegistration(r.account, r.sendTo, r.email)
+	if err != nil {
+		return comms.PrivateMessage(r.sendTo, "registration failed: "+err.Error())
+	}
+	return comms.PrivateMessage(r.sendTo, fmt.Sprintf("sent a verification code to %s, it expires in %d minutes",
+		r.email, int(verificationCodeTTL.Minutes())))
+}
+
+type verifyCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	email   string
+	code    string
+}
+
+func (v *verifyCmd) Execute(comms Comms) error {
+	err := v.bot.completeRegistration(v.account, v.email, v.code)
+	if err != nil {
+		return comms.PrivateMessage(v.sendTo, "verification failed: "+err.Error())
+	}
+	return comms.PrivateMessage(v.sendTo, fmt.Sprintf("%s is verified, your watches can now send email", v.email))
+}
+
+type addWatchCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	token   string
+}
+
+func (a *addWatchCmd) Execute(comms Comms) error {
+	if err := a.bot.addWatch(a.account, a.token); err != nil {
+		return comms.PrivateMessage(a.sendTo, "unable to add watch: "+err.Error())
+	}
+	if strings.EqualFold(a.token, nickToken) {
+		return comms.PrivateMessage(a.sendTo, "watching for your nick, it follows you when you change it")
+	}
+	return comms.PrivateMessage(a.sendTo, fmt.Sprintf("watching for '%s'", a.token))
+}
+
+type stopWatchCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	token   string
+}
+
+func (s *stopWatchCmd) Execute(comms Comms) error {
+	if err := s.bot.stopWatch(s.account, s.token); err != nil {
+		return comms.PrivateMessage(s.sendTo, "unable to stop watch: "+err.Error())
+	}
+	return comms.PrivateMessage(s.sendTo, fmt.Sprintf("stopped watching for '%s'", s.token))
+}
+
+type listWatchesCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+}
+
+func (l *listWatchesCmd) Execute(comms Comms) error {
+	watches, err := l.bot.listWatches(l.account)
+	if err != nil {
+		return comms.PrivateMessage(l.sendTo, "unable to list watches: "+err.Error())
+	}
+	if len(watches) == 0 {
+		return comms.PrivateMessage(l.sendTo, "you are not watching anything")
+	}
+	quoted := make([]string, 0, len(watches))
+	for _, w := range watches {
+		quoted = append(quoted, "'"+w+"'")
+	}
+	return comms.PrivateMessage(l.sendTo, "watching for "+strings.Join(quoted, ", "))
+}
+
+type notifyWhenCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	mode    NotifyMode
+}
+
+func (n *notifyWhenCmd) Execute(comms Comms) error {
+	if err := n.bot.setNotifyMode(n.account, n.mode); err != nil {
+		return comms.PrivateMessage(n.sendTo, "unable to change when you are notified: "+err.Error())
+	}
+
+	var reply string
+	switch n.mode {
+	case NotifyOffline:
+		reply = "you will only be notified while you are not connected"
+	case NotifyAway:
+		reply = "you will only be notified while you are away or not connected"
+	default:
+		reply = "you will be notified about every match"
+	}
+	if _, ok := n.bot.verifiedEmail(n.account); n.mode != NotifyAlways && !ok {
+		reply += ", register an email or matches while you are offline are lost"
+	}
+	return comms.PrivateMessage(n.sendTo, reply)
+}
+
+type tellCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	to      string
+	message string
+}
+
+func (t *tellCmd) Execute(comms Comms) error {
+	note, err := t.bot.leaveNote(sender{nick: t.sendTo, account: t.account}, t.to, t.message)
+	if err != nil {
+		return comms.PrivateMessage(t.sendTo, "unable to leave the note: "+err.Error())
+	}
+	if err := comms.PrivateMessage(t.sendTo, fmt.Sprintf("%s will get your note when they are around, it expires in %d days",
+		note.ToNick, int(noteTTL.Hours()/24))); err != nil {
+		return err
+	}
+	if err := t.bot.mailNote(note); err != nil {
+		return err
+	}
+	return t.bot.deliverNote(note)
+}
+
+type missedCmd struct {
+	bot     *Bot
+	sendTo  string
+	account string
+	req     replayRequest
+}
+
+func (m *missedCmd) Execute(comms Comms) error {
+	lines, total, err := m.bot.missedLines(m.account, m.req)
+	if err != nil {
+		return comms.PrivateMessage(m.sendTo, "unable to replay the room: "+err.Error())
+	}
+	if total == 0 {
+		return comms.PrivateMessage(m.sendTo, "you didn't miss anything")
+	}
+
+	header := fmt.Sprintf("replaying %d lines", total)
+	if total > len(lines) {
+		header = fmt.Sprintf("replaying the last %d of %d lines", len(lines), total)
+	}
+	if err := comms.PrivateMessage(m.sendTo, header); err != nil {
+		return err
+	}
+	// notifications go out at the lowest priority so a long replay doesn't
+	// hold up replies to other users
+	for _, line := range lines {
+		if err := comms.Notification(m.sendTo, m.bot.formatHistory(line)); err != nil {
+			return fmt.Errorf("unable to replay history to %s: %w", m.sendTo, err)
+		}
+	}
+	return nil
+}
+
+type searchCmd struct {
+	bot    *Bot
+	sendTo string
+	terms  string
+}
+
+func (s *searchCmd) Execute(comms Comms) error {
+	lines, err := s.bot.search(s.terms)
+	if err != nil {
+		return comms.PrivateMessage(s.sendTo, "unable to search: "+err.Error())
+	}
+	if len(lines) == 0 {
+		return comms.PrivateMessage(s.sendTo, "nothing in the archive matches")
+	}
+	for _, line := range lines {
+		if err := comms.Notification(s.sendTo, line); err != nil {
+			return fmt.Errorf("unable to send search results to %s: %w", s.sendTo, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package notifyi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// storeSchemaVersion is the version of the state written by this build
+const storeSchemaVersion = 2
+
+// migrations[i] upgrades raw state from version i to version i+1, the raw
+// form lets a migration reshape fields the current structs no longer have
+var migrations = []func(raw map[string]interface{}) error{
+	// 0 -> 1: files written before versioning had no version field
+	func(raw map[string]interface{}) error {
+		for _, key := range []string{"users", "pending", "watches"} {
+			if raw[key] == nil {
+				raw[key] = map[string]interface{}{}
+			}
+		}
+		return nil
+	},
+	// 1 -> 2: accounts moved from nicks to key fingerprints, nothing proves
+	// which key owned a nick so the old entries become legacy accounts
+	// whose watches go to whoever verifies the same email again
+	func(raw map[string]interface{}) error {
+		users, _ := raw["users"].(map[string]interface{})
+		watches, _ := raw["watches"].(map[string]interface{})
+
+		legacy := map[string]interface{}{}
+		for nick, w := range watches {
+			legacy[nick] = map[string]interface{}{"watches": w}
+		}
+		for nick, u := range users {
+			user, _ := u.(map[string]interface{})
+			email, _ := user["Email"].(string)
+			if email == "" {
+				continue
+			}
+			entry, ok := legacy[nick].(map[string]interface{})
+			if !ok {
+				entry = map[string]interface{}{}
+				legacy[nick] = entry
+			}
+			entry["email"] = email
+		}
+
+		raw["legacy"] = legacy
+		raw["users"] = map[string]interface{}{}
+		raw["pending"] = map[string]interface{}{}
+		raw["watches"] = map[string]interface{}{}
+		return nil
+	},
+}
+
+// NewFileStore opens the JSON state file at path, creating it when missing
+// and migrating it when it was written by an older version. The room
+// history is appended to a file next to it.
+func NewFileStore(path string) (Store, error) {
+	state, err := loadState(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create store directory: %w", err)
+	}
+	log, history, err := openHistoryLog(historyPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if len(state.History) > 0 {
+		// the history used to live in the state, move it to the log before
+		// the state is saved without it
+		history = append(state.History, history...)
+		state.History = nil
+		if err := log.rewrite(history); err != nil {
+			log.Close()
+			return nil, err
+		}
+	}
+	// a store that wasn't closed leaves up to twice the entries it keeps,
+	// the log itself shrinks on one of the next appends
+	if over := len(history) - maxHistory; over > 0 {
+		history = append([]HistoryEntry(nil), history[over:]...)
+	}
+	s := &stateStore{
+		state: state,
+		persist: func(state *storeState) error {
+			return saveState(path, state)
+		},
+		history: history,
+		log:     log,
+	}
+	if err := saveState(path, state); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func loadState(path string) (*storeState, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newStoreState(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read store %s: %w", path, err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("unable to parse store %s: %w", path, err)
+	}
+	if err := migrate(raw); err != nil {
+		return nil, fmt.Errorf("unable to migrate store %s: %w", path, err)
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	state := newStoreState()
+	if err := json.Unmarshal(migrated, state); err != nil {
+		return nil, fmt.Errorf("unable to decode store %s: %w", path, err)
+	}
+	return state, nil
+}
+
+func migrate(raw map[string]interface{}) error {
+	version := 0
+	if v, ok := raw["version"].(float64); ok {
+		version = int(v)
+	}
+	if version > storeSchemaVersion {
+		return fmt.Errorf("store has version %d, this build only knows up to %d", version, storeSchemaVersion)
+	}
+	for ; version < storeSchemaVersion; version++ {
+		if err := migrations[version](raw); err != nil {
+			return fmt.Errorf("migration from version %d failed: %w", version, err)
+		}
+		raw["version"] = version + 1
+	}
+	return nil
+}
+
+// saveState writes to a temporary file and renames it so a crash never
+// leaves a half written store behind
+func saveState(path string, state *storeState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode store: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to create store directory: %w", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary store file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write store: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to sync store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("unable to replace store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package notifyi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxHistory is how many room events the bot remembers
+	maxHistory = 1000
+	// maxReplay caps a replay, every line is a rate limited PM
+	maxReplay = 50
+)
+
+var (
+	errNeverLeft     = errors.New("the bot hasn't seen you leave, ask for a number of lines or a duration instead")
+	errReplayRequest = errors.New("give a number of lines like 20 or a duration like 2h")
+)
+
+// HistoryKind is what happened in a history entry
+type HistoryKind string
+
+const (
+	// HistoryPublic is a message to the room
+	HistoryPublic HistoryKind = "public"
+	// HistoryAction is a /me
+	HistoryAction HistoryKind = "action"
+	// HistoryJoin is a user connecting
+	HistoryJoin HistoryKind = "join"
+	// HistoryLeft is a user disconnecting
+	HistoryLeft HistoryKind = "left"
+)
+
+// HistoryEntry is one event in the room
+type HistoryEntry struct {
+	Time    time.Time
+	Kind    HistoryKind
+	From    string
+	Message string `json:",omitempty"`
+}
+
+func (e HistoryEntry) String() string {
+	switch e.Kind {
+	case HistoryAction:
+		return fmt.Sprintf("** %s %s", e.From, e.Message)
+	case HistoryJoin:
+		return fmt.Sprintf("* %s joined", e.From)
+	case HistoryLeft:
+		return fmt.Sprintf("* %s left", e.From)
+	}
+	return fmt.Sprintf("%s: %s", e.From, e.Message)
+}
+
+// replayRequest is what part of the history a user asked for, one of the
+// fields is set, none means since they last left
+type replayRequest struct {
+	lines int
+	since time.Duration
+}
+
+func parseReplayRequest(arg string) (replayRequest, error) {
+	if n, err := strconv.Atoi(arg); err == nil {
+		if n <= 0 {
+			return replayRequest{}, errReplayRequest
+		}
+		return replayRequest{lines: n}, nil
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+		return replayRequest{since: d}, nil
+	}
+	return replayRequest{}, errReplayRequest
+}
+
+func (b *Bot) record(kind HistoryKind, from, message string) error {
+	if from == b.name {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.store.AppendHistory(HistoryEntry{Time: b.now(), Kind: kind, From: from, Message: message}, maxHistory)
+}
+
+// recordLeft remembers when the account using nick left, nick alone is
+// trusted here since it only decides which public lines to replay
+func (b *Bot) recordLeft(nick string) error {
+	account, known := b.accountFor(nick)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	users, err := b.store.AllUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if (known && u.Fingerprint == account) || (!known && u.Name == nick) {
+			u.LastLeft = b.now()
+			if err := b.store.PutUser(u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missedLines picks the history entries req asks for, newest last. The
+// second value is how many matched before capping at maxReplay.
+func (b *Bot) missedLines(account string, req replayRequest) ([]HistoryEntry, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	history, err := b.store.History()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var picked []HistoryEntry
+	switch {
+	case req.lines > 0:
+		if req.lines < len(history) {
+			history = history[len(history)-req.lines:]
+		}
+		picked = history
+	default:
+		var since time.Time
+		if req.since > 0 {
+			since = b.now().Add(-req.since)
+		} else {
+			user, ok, err := b.store.User(account)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !ok || user.LastLeft.IsZero() {
+				return nil, 0, errNeverLeft
+			}
+			since = user.LastLeft
+		}
+		for i, e := range history {
+			if e.Time.After(since) {
+				picked = history[i:]
+				break
+			}
+		}
+	}
+
+	total := len(picked)
+	if total > maxReplay {
+		picked = picked[total-maxReplay:]
+	}
+	return picked, total, nil
+}
+
+// formatHistory prefixes e with its time, with the date for older entries
+func (b *Bot) formatHistory(e HistoryEntry) string {
+	layout := "15:04"
+	if b.now().Sub(e.Time) > 24*time.Hour {
+		layout = "Jan 2 15:04"
+	}
+	return fmt.Sprintf("[%s] %s", e.Time.Format(layout), e)
+}
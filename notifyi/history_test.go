@@ -0,0 +1,210 @@
+package notifyi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMissedSinceLastLeft(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	now := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+	bot.now = func() time.Time { return now }
+	tick := func() { now = now.Add(time.Minute) }
+
+	identify(bot, "alice", "SHA256:alice")
+	bot.PrivateMessage("alice", "list-watches")
+	bot.PublicMessage("bob", "before")
+	tick()
+	bot.UserLeftMessage("alice")
+	tick()
+	bot.PublicMessage("bob", "while you were out")
+	tick()
+	bot.ActionMessage("carol", "waves")
+	tick()
+	bot.UserJoinedMessage("alice")
+	identify(bot, "alice", "SHA256:alice")
+
+	bot.PrivateMessage("alice", "missed")
+	want := []string{
+		"[09:02] bob: while you were out",
+		"[09:03] ** carol waves",
+		"[09:04] * alice joined",
+	}
+	if !reflect.DeepEqual(comms.notifications["alice"], want) {
+		t.Fatalf("unexpected replay: %q", comms.notifications["alice"])
+	}
+}
+
+func TestMissedLinesAndDuration(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	now := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+	bot.now = func() time.Time { return now }
+	identify(bot, "alice", "SHA256:alice")
+
+	for i := 0; i < maxReplay+10; i++ {
+		bot.PublicMessage("bob", fmt.Sprint(i))
+		now = now.Add(time.Minute)
+	}
+
+	bot.PrivateMessage("alice", "missed 2")
+	if got := comms.notifications["alice"]; len(got) != 2 || got[1] != "[09:59] bob: 59" {
+		t.Fatalf("unexpected replay of 2 lines: %q", got)
+	}
+
+	comms.notifications["alice"] = nil
+	bot.PrivateMessage("alice", "missed 5m")
+	if got := comms.notifications["alice"]; len(got) != 4 {
+		t.Fatalf("unexpected replay of 5 minutes: %q", got)
+	}
+
+	comms.notifications["alice"] = nil
+	bot.PrivateMessage("alice", "missed 2h")
+	replies := comms.private["alice"]
+	if got := comms.notifications["alice"]; len(got) != maxReplay || replies[len(replies)-1] != "replaying the last 50 of 60 lines" {
+		t.Fatalf("replay was not capped: %d lines, %q", len(got), replies[len(replies)-1])
+	}
+
+	bot.PrivateMessage("alice", "missed yesterday")
+	replies = comms.private["alice"]
+	if replies[len(replies)-1] != errReplayRequest.Error()+", usage: /msg notifyi missed [lines|duration]" {
+		t.Fatalf("unexpected reply: %q", replies[len(replies)-1])
+	}
+}
+
+func TestHistoryIsBoundedAndPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := store.AppendHistory(HistoryEntry{Kind: HistoryPublic, From: "bob", Message: fmt.Sprint(i)}, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := reopened.History()
+	if err != nil || len(history) != 3 || history[0].Message != "2" {
+		t.Fatalf("unexpected history after restart: %+v %v", history, err)
+	}
+}
+
+func TestHistoryIsBoundedAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxHistory+maxHistory/2; i++ {
+		if err := store.AppendHistory(HistoryEntry{Kind: HistoryPublic, From: "bob", Message: fmt.Sprint(i)}, maxHistory); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reopened without Close, like after a crash
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	history, err := reopened.History()
+	if err != nil || len(history) != maxHistory || history[0].Message != fmt.Sprint(maxHistory/2) {
+		t.Fatalf("expected the newest %d entries after a crash, got %d: %v", maxHistory, len(history), err)
+	}
+}
+
+func TestHistoryAppendsLeaveStateAlone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := store.AppendHistory(HistoryEntry{Kind: HistoryPublic, From: "bob", Message: fmt.Sprint(i)}, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Fatalf("history was written to the state:\n%s", after)
+	}
+	_, lines, err := readHistoryLog(historyPath(path))
+	if err != nil || lines > 20 {
+		t.Fatalf("history log holds %d lines: %v", lines, err)
+	}
+}
+
+func TestHistoryMovesOutOfOldState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	old := `{"version": 2, "users": {}, "pending": {}, "watches": {}, "notes": {},
+		"history": [{"Kind": "public", "From": "bob", "Message": "old"}]}`
+	if err := ioutil.WriteFile(path, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendHistory(HistoryEntry{Kind: HistoryPublic, From: "bob", Message: "new"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "history") {
+		t.Fatalf("state still holds the history:\n%s", content)
+	}
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	history, _ := reopened.History()
+	if len(history) != 2 || history[0].Message != "old" || history[1].Message != "new" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+}
+
+func TestHistorySkipsTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	log := `{"Kind":"public","From":"bob","Message":"kept"}` + "\n" + `{"Kind":"public","Fr`
+	if err := ioutil.WriteFile(historyPath(path), []byte(log), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	history, _ := store.History()
+	if len(history) != 1 || history[0].Message != "kept" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+}
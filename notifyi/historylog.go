@@ -0,0 +1,133 @@
+package notifyi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// historyLog keeps the room history of a file store in its own file with
+// one JSON entry per line. Appends write a single line without syncing, the
+// history is best effort and losing the last few lines to a power cut is
+// cheaper than rewriting the state for every line said in the room. The
+// file is rewritten once it holds twice the entries the store keeps.
+type historyLog struct {
+	path  string
+	file  *os.File
+	lines int
+}
+
+// historyPath is where the history of the store at statePath lives
+func historyPath(statePath string) string {
+	return statePath + ".history"
+}
+
+// openHistoryLog reads the entries in the log at path and opens it for
+// appending. Lines that don't decode, like one cut short by a crash, are
+// skipped.
+func openHistoryLog(path string) (*historyLog, []HistoryEntry, error) {
+	entries, lines, err := readHistoryLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open history %s: %w", path, err)
+	}
+	return &historyLog{path: path, file: file, lines: lines}, entries, nil
+}
+
+func readHistoryLog(path string) ([]HistoryEntry, int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to open history %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines++
+		var e HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("unable to read history %s: %w", path, err)
+	}
+	return entries, lines, nil
+}
+
+// append writes entry to the end of the log, kept is the history the store
+// holds after adding it and is what the log shrinks to when it gets too long
+func (l *historyLog) append(entry HistoryEntry, kept []HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to encode history entry: %w", err)
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("unable to append to history: %w", err)
+	}
+	l.lines++
+	if l.lines > 2*len(kept) {
+		return l.rewrite(kept)
+	}
+	return nil
+}
+
+// rewrite replaces the log with entries, going through a temporary file so
+// a crash leaves either the old or the new log
+func (l *historyLog) rewrite(entries []HistoryEntry) error {
+	dir := filepath.Dir(l.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary history file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return fmt.Errorf("unable to write history: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write history: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to sync history: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to close history: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("unable to replace history: %w", err)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to reopen history: %w", err)
+	}
+	l.file.Close()
+	l.file = file
+	l.lines = len(entries)
+	return nil
+}
+
+func (l *historyLog) Close() error {
+	return l.file.Close()
+}
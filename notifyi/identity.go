@@ -0,0 +1,245 @@
+package notifyi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ssh-chat lets anyone take any free nick, so accounts belong to the
+// fingerprint of the key a user connected with. The bot asks for it with
+// /whois and keeps a roster of nick to fingerprint that follows renames
+// and forgets nicks when they leave.
+
+// noPublicKey is the fingerprint /whois shows for users without a key
+const noPublicKey = "(no public key)"
+
+// whoisTimeout is how long a /whois may go unanswered before it is sent again
+const whoisTimeout = 30 * time.Second
+
+var errNoPublicKey = errors.New("you connected without an ssh key, accounts are tied to keys since anyone can take a nick")
+
+// sender is who a command came from, account is their key fingerprint and
+// empty for commands that don't need one
+type sender struct {
+	nick    string
+	account string
+}
+
+// whoisWait is the work queued for a nick until its /whois reply arrives
+type whoisWait struct {
+	sent time.Time
+	// then is called with the nick the user has by the time the reply
+	// arrives and their fingerprint, or "" when the user has no key
+	then []func(nick, fingerprint string) error
+}
+
+// accountFor returns the fingerprint of whoever uses nick right now
+func (b *Bot) accountFor(nick string) (string, bool) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	fingerprint, ok := b.sessions[nick]
+	return fingerprint, ok
+}
+
+// nickFor returns a nick the owner of fingerprint is online with
+func (b *Bot) nickFor(fingerprint string) (string, bool) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	var nicks []string
+	for nick, fp := range b.sessions {
+		if fp == fingerprint {
+			nicks = append(nicks, nick)
+		}
+	}
+	if len(nicks) == 0 {
+		return "", false
+	}
+	sort.Strings(nicks)
+	return nicks[0], true
+}
+
+// withAccount calls then with nick's fingerprint, right away when it is
+// known and once ssh-chat answered a /whois otherwise
+func (b *Bot) withAccount(nick string, then func(nick, fingerprint string) error) error {
+	b.sessionMu.Lock()
+	if fingerprint, ok := b.sessions[nick]; ok {
+		b.sessionMu.Unlock()
+		return then(nick, fingerprint)
+	}
+
+	now := b.now()
+	wait, ok := b.waiting[nick]
+	if !ok {
+		wait = &whoisWait{}
+		b.waiting[nick] = wait
+	}
+	// a reply can go missing when the user left before the server saw the
+	// /whois, ask again once the previous one is clearly lost
+	ask := !ok || now.Sub(wait.sent) > whoisTimeout
+	if ask {
+		wait.sent = now
+	}
+	wait.then = append(wait.then, then)
+	b.sessionMu.Unlock()
+
+	if ask {
+		return b.comms.PublicMessage("/whois " + nick)
+	}
+	return nil
+}
+
+// WhoisMessage takes one field of a /whois reply, the name field comes
+// first and the fingerprint field resolves the work waiting on that nick
+func (b *Bot) WhoisMessage(field, value string) error {
+	b.sessionMu.Lock()
+	switch field {
+	case "name":
+		b.whoisName = value
+		b.sessionMu.Unlock()
+		return nil
+	case "fingerprint":
+	default:
+		b.sessionMu.Unlock()
+		return nil
+	}
+
+	nick := b.whoisName
+	b.whoisName = ""
+	var then []func(nick, fingerprint string) error
+	if wait, ok := b.waiting[nick]; ok {
+		then = wait.then
+		delete(b.waiting, nick)
+	}
+	fingerprint := value
+	if fingerprint == noPublicKey {
+		fingerprint = ""
+	} else if nick != "" {
+		b.sessions[nick] = fingerprint
+	}
+	if _, ok := b.roster[nick]; !ok && nick != "" {
+		// only connected users have a /whois
+		b.roster[nick] = member{}
+	}
+	b.sessionMu.Unlock()
+
+	var errs []string
+	for _, fn := range then {
+		if err := fn(nick, fingerprint); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to finish work waiting on %s: %s", nick, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// forget drops what the bot knows about nicks that may now belong to
+// someone else
+func (b *Bot) forget(nicks ...string) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	for _, nick := range nicks {
+		delete(b.sessions, nick)
+		delete(b.waiting, nick)
+	}
+}
+
+// rename moves the roster entry and any work waiting on a /whois from one
+// nick to the other, a rename is always the same connection and key
+func (b *Bot) rename(from, to string) error {
+	b.sessionMu.Lock()
+	delete(b.sessions, to)
+	delete(b.waiting, to)
+	b.roster[to] = b.roster[from]
+	delete(b.roster, from)
+	if fingerprint, ok := b.sessions[from]; ok {
+		b.sessions[to] = fingerprint
+		delete(b.sessions, from)
+	}
+
+	// a /whois for the old nick is answered for whoever has it now, if
+	// anyone, so the waiting work needs a fresh one for the new nick
+	wait, ok := b.waiting[from]
+	delete(b.waiting, from)
+	if ok {
+		wait.sent = b.now()
+		b.waiting[to] = wait
+	}
+	b.sessionMu.Unlock()
+
+	if ok {
+		return b.comms.PublicMessage("/whois " + to)
+	}
+	return b.touchNick(to)
+}
+
+// touchNick keeps the last seen nick of the account using nick current
+func (b *Bot) touchNick(nick string) error {
+	account, ok := b.accountFor(nick)
+	if !ok {
+		return nil
+	}
+	b.mu.Lock()
+	_, known, err := b.store.User(account)
+	b.mu.Unlock()
+	if err != nil || !known {
+		return err
+	}
+	return b.seen(nick, account)
+}
+
+// currentNick is the nick the owner of account is online with, or the last
+// one they talked to the bot with
+func (b *Bot) currentNick(account string) (string, bool) {
+	if nick, ok := b.nickFor(account); ok {
+		return nick, true
+	}
+	return b.lastNick(account)
+}
+
+// onlineNicks maps the fingerprint of everyone online to the nick nickFor
+// returns for it, in one pass for callers looking up many accounts
+func (b *Bot) onlineNicks() map[string]string {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	nicks := make(map[string]string, len(b.sessions))
+	for nick, fp := range b.sessions {
+		if current, ok := nicks[fp]; !ok || nick < current {
+			nicks[fp] = nick
+		}
+	}
+	return nicks
+}
+
+// lastNick is the nick the owner of account last talked to the bot with
+func (b *Bot) lastNick(account string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	user, ok, err := b.store.User(account)
+	if err != nil || !ok || user.Name == "" {
+		return "", false
+	}
+	return user.Name, true
+}
+
+// seen records the nick an account last used
+func (b *Bot) seen(nick, account string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	user, ok, err := b.store.User(account)
+	if err != nil {
+		return err
+	}
+	if ok && user.Name == nick {
+		return nil
+	}
+	if !ok {
+		user = User{Fingerprint: account, Created: b.now()}
+	}
+	user.Name = nick
+	return b.store.PutUser(user)
+}
@@ -0,0 +1,124 @@
+package notifyi
+
+import (
+	"reflect"
+	"testing"
+)
+
+// identify feeds the bot the /whois reply for nick
+func identify(bot *Bot, nick, fingerprint string) {
+	bot.WhoisMessage("name", nick)
+	bot.WhoisMessage("fingerprint", fingerprint)
+}
+
+func TestCommandsWaitForWhois(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+
+	bot.PrivateMessage("alice", "add-watch deploy")
+	bot.PrivateMessage("alice", "list-watches")
+	if !reflect.DeepEqual(comms.public, []string{"/whois alice"}) {
+		t.Fatalf("expected a single whois, sent: %q", comms.public)
+	}
+	if len(comms.private["alice"]) != 0 {
+		t.Fatalf("commands ran before the key was known: %q", comms.private["alice"])
+	}
+
+	identify(bot, "alice", "SHA256:alice")
+	want := []string{"watching for 'deploy'", "watching for 'deploy'"}
+	if !reflect.DeepEqual(comms.private["alice"], want) {
+		t.Fatalf("unexpected replies: %q", comms.private["alice"])
+	}
+	watches, _ := bot.store.Watches("SHA256:alice")
+	if !reflect.DeepEqual(watches, []string{"deploy"}) {
+		t.Fatalf("watch not stored under the key: %q", watches)
+	}
+}
+
+func TestRenameForgetsIdentity(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	identify(bot, "alice", "SHA256:alice")
+	bot.PrivateMessage("alice", "add-watch deploy")
+
+	bot.UserLeftMessage("alice")
+	bot.UsernameChangeMessage("mallory", "alice")
+	bot.PrivateMessage("alice", "stop-watch deploy")
+	identify(bot, "alice", "SHA256:mallory")
+
+	watches, _ := bot.store.Watches("SHA256:alice")
+	if !reflect.DeepEqual(watches, []string{"deploy"}) {
+		t.Fatalf("impersonator changed alice's watches: %q", watches)
+	}
+}
+
+func TestKeylessUsersAreTurnedAway(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+
+	bot.PrivateMessage("guest", "add-watch deploy")
+	identify(bot, "guest", noPublicKey)
+
+	replies := comms.private["guest"]
+	if len(replies) != 1 || replies[0] != errNoPublicKey.Error() {
+		t.Fatalf("unexpected replies: %q", replies)
+	}
+	if all, _ := bot.store.AllWatches(); len(all) != 0 {
+		t.Fatalf("keyless user got watches: %q", all)
+	}
+}
+
+func TestRenameKeepsIdentity(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	identify(bot, "alice", "SHA256:alice")
+	bot.PrivateMessage("alice", "add-watch deploy")
+
+	bot.UsernameChangeMessage("alice", "alice_away")
+	bot.PrivateMessage("alice_away", "list-watches")
+	if len(comms.public) != 0 {
+		t.Fatalf("renamed user was looked up again: %q", comms.public)
+	}
+	if replies := comms.private["alice_away"]; len(replies) != 1 || replies[0] != "watching for 'deploy'" {
+		t.Fatalf("unexpected replies after rename: %q", replies)
+	}
+
+	bot.PublicMessage("bob", "deploy failed")
+	if len(comms.notifications["alice_away"]) != 1 || len(comms.notifications["alice"]) != 0 {
+		t.Fatalf("notification went to the old nick: %q", comms.notifications)
+	}
+}
+
+func TestRenameWhileWaitingForWhois(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+
+	bot.PrivateMessage("alice", "list-watches")
+	bot.UsernameChangeMessage("alice", "alice2")
+	identify(bot, "alice2", "SHA256:alice")
+
+	if want := []string{"/whois alice", "/whois alice2"}; !reflect.DeepEqual(comms.public, want) {
+		t.Fatalf("unexpected lookups: %q", comms.public)
+	}
+	if replies := comms.private["alice2"]; len(replies) != 1 {
+		t.Fatalf("reply did not follow the rename: %q", comms.private)
+	}
+}
+
+func TestOnlineNicksAgreesWithNickFor(t *testing.T) {
+	bot := New("notifyi", newRecordingComms())
+	bot.NamesMessage([]string{"alice", "alice_", "bob"})
+	identify(bot, "alice_", "SHA256:alice")
+	identify(bot, "alice", "SHA256:alice")
+	identify(bot, "bob", "SHA256:bob")
+
+	online := bot.onlineNicks()
+	if len(online) != 2 {
+		t.Fatalf("expected one nick per account, got %q", online)
+	}
+	for _, account := range []string{"SHA256:alice", "SHA256:bob"} {
+		if nick, _ := bot.nickFor(account); online[account] != nick {
+			t.Errorf("%s: onlineNicks has %q, nickFor %q", account, online[account], nick)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package notifyi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/voldyman/ssh-chat-notify/mail"
+)
+
+// Mailer delivers email to registered users
+type Mailer interface {
+	SendMail(to, subject, body string) error
+}
+
+// SMTPMailer sends mail through an SMTP server
+type SMTPMailer struct {
+	cfg mail.Config
+}
+
+// NewSMTPMailer creates a mailer for the given server
+func NewSMTPMailer(cfg mail.Config) *SMTPMailer {
+	return &SMTPMailer{cfg: cfg}
+}
+
+// SendMail sends a plain text mail
+func (m *SMTPMailer) SendMail(to, subject, body string) error {
+	msg := mail.Message{To: []string{to}, Subject: subject, Body: body}
+	if err := mail.Send(context.Background(), m.cfg, msg); err != nil {
+		return fmt.Errorf("unable to send mail to %s: %w", to, err)
+	}
+	return nil
+}
+
+// maxMailers caps the mails sent in the background at once
+const maxMailers = 4
+
+// mailLater sends mail off the event loop so a slow server only delays
+// the mail, failures go to the error handler
+func (b *Bot) mailLater(to, subject, body string) {
+	b.mailWG.Add(1)
+	go func() {
+		defer b.mailWG.Done()
+		b.mailSlots <- struct{}{}
+		defer func() { <-b.mailSlots }()
+		if err := b.mailer.SendMail(to, subject, body); err != nil && b.onError != nil {
+			b.onError(err)
+		}
+	}()
+}
+
+// Drain waits for the mail being sent in the background
+func (b *Bot) Drain() {
+	b.mailWG.Wait()
+}
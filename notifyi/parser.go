@@ -1,5 +1,107 @@
 package notifyi
 
-func parsePrivateMessage(message string) executableCmd {
-	return nil
+import (
+	"fmt"
+	"strings"
+)
+
+// parsePrivateMessage turns a PM into the command it asks for, nil is
+// returned for messages that don't name a known command
+func (b *Bot) parsePrivateMessage(from sender, message string) (executableCmd, commandSpec, error) {
+	name, _ := cutFields(message, 1)
+	if len(name) == 0 {
+		return nil, commandSpec{}, nil
+	}
+	spec, ok := lookupCommand(name[0])
+	if !ok {
+		return nil, commandSpec{}, nil
+	}
+
+	var args []string
+	if spec.rest {
+		words, rest := cutFields(message, spec.minArgs)
+		args = words[1:]
+		if rest != "" {
+			args = append(args, rest)
+		}
+	} else {
+		tokens, err := tokenize(message)
+		if err != nil {
+			return nil, spec, err
+		}
+		args = tokens[1:]
+	}
+
+	if len(args) < spec.minArgs || len(args) > spec.maxArgs {
+		return nil, spec, &usageError{myusername: b.name, spec: spec}
+	}
+	cmd, err := spec.build(b, from, args)
+	if err != nil {
+		return nil, spec, &usageError{myusername: b.name, spec: spec, reason: err.Error()}
+	}
+	return cmd, spec, nil
+}
+
+// cutFields splits the first n whitespace separated words off message and
+// returns them with the rest of the message as it was typed
+func cutFields(message string, n int) ([]string, string) {
+	var words []string
+	rest := strings.TrimLeft(message, " \t")
+	for len(words) < n && rest != "" {
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		words = append(words, rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+	return words, strings.TrimRight(rest, " \t")
+}
+
+// tokenize splits a message on whitespace, single or double quotes group
+// words into one argument and a backslash escapes the next character
+func tokenize(message string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inToken := false
+	var quote rune
+
+	runes := []rune(message)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && quote != '\'':
+			if i+1 == len(runes) {
+				return nil, fmt.Errorf("message ends with an unfinished escape")
+			}
+			i++
+			current.WriteRune(runes[i])
+			inToken = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t':
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("missing closing %c quote", quote)
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
 }
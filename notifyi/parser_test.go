@@ -0,0 +1,97 @@
+package notifyi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	checks := []struct {
+		msg    string
+		tokens []string
+		fails  bool
+	}{
+		{msg: "help", tokens: []string{"help"}},
+		{msg: "  add-watch   voldyman ", tokens: []string{"add-watch", "voldyman"}},
+		{msg: `add-watch "merge conflict"`, tokens: []string{"add-watch", "merge conflict"}},
+		{msg: `add-watch 'say "hi"'`, tokens: []string{"add-watch", `say "hi"`}},
+		{msg: `add-watch don\'t`, tokens: []string{"add-watch", "don't"}},
+		{msg: `add-watch ""`, tokens: []string{"add-watch", ""}},
+		{msg: `add-watch "unfinished`, fails: true},
+	}
+
+	for _, check := range checks {
+		tokens, err := tokenize(check.msg)
+		if check.fails {
+			if err == nil {
+				t.Fatal("expected tokenizing to fail:", check.msg)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(tokens, check.tokens) {
+			t.Fatalf("unable to tokenize %s: got %q, %v", check.msg, tokens, err)
+		}
+	}
+}
+
+type recordingComms struct {
+	private       map[string][]string
+	notifications map[string][]string
+	public        []string
+}
+
+func newRecordingComms() *recordingComms {
+	return &recordingComms{private: map[string][]string{}, notifications: map[string][]string{}}
+}
+
+func (r *recordingComms) PrivateMessage(toUsername, message string) error {
+	r.private[toUsername] = append(r.private[toUsername], message)
+	return nil
+}
+
+func (r *recordingComms) Notification(toUsername, message string) error {
+	r.notifications[toUsername] = append(r.notifications[toUsername], message)
+	return nil
+}
+
+func (r *recordingComms) PublicMessage(message string) error {
+	r.public = append(r.public, message)
+	return nil
+}
+
+func TestCommandUsageErrors(t *testing.T) {
+	checks := []struct {
+		msg   string
+		reply string
+	}{
+		{msg: "register", reply: "usage: /msg notifyi register <email>"},
+		{msg: "register not-an-email", reply: "'not-an-email' is not an email address, usage: /msg notifyi register <email>"},
+		{msg: "verify a@b.c", reply: "usage: /msg notifyi verify <email> <verification code>"},
+		{msg: "add-watch one two", reply: "usage: /msg notifyi add-watch <token>"},
+	}
+
+	for _, check := range checks {
+		comms := newRecordingComms()
+		bot := New("notifyi", comms)
+		bot.PrivateMessage("alice", check.msg)
+
+		replies := comms.private["alice"]
+		if len(replies) != 1 || replies[0] != check.reply {
+			t.Fatalf("unexpected reply to '%s': %q", check.msg, replies)
+		}
+	}
+}
+
+func TestHelpListsEveryCommand(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	bot.PrivateMessage("alice", "help")
+
+	help := strings.Join(comms.private["alice"], "\n")
+	for _, spec := range commands {
+		if !strings.Contains(help, spec.usage("notifyi")) {
+			t.Fatalf("help does not mention %s:\n%s", spec.name, help)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package notifyi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NotifyMode is when a user wants to hear about their watches
+type NotifyMode string
+
+const (
+	// NotifyAlways sends every match, it is what users get until they choose
+	NotifyAlways NotifyMode = "always"
+	// NotifyOffline only sends matches while the user isn't connected
+	NotifyOffline NotifyMode = "offline"
+	// NotifyAway sends matches while the user is away or not connected
+	NotifyAway NotifyMode = "away"
+)
+
+var notifyModes = []NotifyMode{NotifyAlways, NotifyOffline, NotifyAway}
+
+var errNotifyMode = fmt.Errorf("pick one of %s", joinModes())
+
+func joinModes() string {
+	names := make([]string, 0, len(notifyModes))
+	for _, mode := range notifyModes {
+		names = append(names, string(mode))
+	}
+	return strings.Join(names, ", ")
+}
+
+func parseNotifyMode(s string) (NotifyMode, error) {
+	for _, mode := range notifyModes {
+		if strings.EqualFold(s, string(mode)) {
+			return mode, nil
+		}
+	}
+	return "", errNotifyMode
+}
+
+// presence is where a user is as far as the room knows
+type presence int
+
+const (
+	presenceOffline presence = iota
+	presenceAway
+	presenceActive
+)
+
+// wants reports whether a user with this mode should hear about a match
+// while they are in state
+func (m NotifyMode) wants(state presence) bool {
+	switch m {
+	case NotifyOffline:
+		return state == presenceOffline
+	case NotifyAway:
+		return state != presenceActive
+	}
+	return true
+}
+
+// member is someone in the room, away is set by ssh-chat's /away
+type member struct {
+	away bool
+}
+
+// Connected is called whenever the bot (re)connects, what it knew about the
+// room may be stale so it starts over from a /names snapshot
+func (b *Bot) Connected() error {
+	b.sessionMu.Lock()
+	b.sessions = map[string]string{}
+	b.waiting = map[string]*whoisWait{}
+	b.roster = map[string]member{}
+	b.whoisName = ""
+	b.sessionMu.Unlock()
+	return b.comms.PublicMessage("/names")
+}
+
+// NamesMessage replaces the roster with ssh-chat's list of connected users
+func (b *Bot) NamesMessage(names []string) error {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+
+	roster := make(map[string]member, len(names))
+	for _, nick := range names {
+		roster[nick] = b.roster[nick]
+	}
+	for nick := range b.sessions {
+		if _, ok := roster[nick]; !ok {
+			delete(b.sessions, nick)
+		}
+	}
+	b.roster = roster
+	return nil
+}
+
+// AwayMessage records a user going away or coming back
+func (b *Bot) AwayMessage(username string, away bool) error {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	b.roster[username] = member{away: away}
+	return nil
+}
+
+func (b *Bot) joined(nick string) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	b.roster[nick] = member{}
+}
+
+func (b *Bot) left(nick string) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	delete(b.roster, nick)
+}
+
+// presenceOfNick must be called with sessionMu held
+func (b *Bot) presenceOfNick(nick string) presence {
+	m, ok := b.roster[nick]
+	switch {
+	case !ok:
+		return presenceOffline
+	case m.away:
+		return presenceAway
+	}
+	return presenceActive
+}
+
+// withPresence calls then with the nick the owner of account is online
+// with, empty when they are offline, and their presence. A nick the account
+// used before is only trusted after /whois shows it is still theirs.
+func (b *Bot) withPresence(account string, then func(nick string, state presence) error) error {
+	b.sessionMu.Lock()
+	for nick, fingerprint := range b.sessions {
+		if fingerprint == account {
+			if state := b.presenceOfNick(nick); state != presenceOffline {
+				b.sessionMu.Unlock()
+				return then(nick, state)
+			}
+		}
+	}
+	b.sessionMu.Unlock()
+
+	last, ok := b.currentNick(account)
+	if !ok {
+		return then("", presenceOffline)
+	}
+	b.sessionMu.Lock()
+	_, online := b.roster[last]
+	b.sessionMu.Unlock()
+	if !online {
+		return then("", presenceOffline)
+	}
+
+	return b.withAccount(last, func(nick, fingerprint string) error {
+		if fingerprint != account {
+			return then("", presenceOffline)
+		}
+		b.sessionMu.Lock()
+		state := b.presenceOfNick(nick)
+		b.sessionMu.Unlock()
+		return then(nick, state)
+	})
+}
+
+func (b *Bot) setNotifyMode(account string, mode NotifyMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	user, ok, err := b.store.User(account)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("unknown account")
+	}
+	user.NotifyMode = mode
+	return b.store.PutUser(user)
+}
+
+func (b *Bot) notifyMode(account string) NotifyMode {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	user, ok, err := b.store.User(account)
+	if err != nil || !ok || user.NotifyMode == "" {
+		return NotifyAlways
+	}
+	return user.NotifyMode
+}
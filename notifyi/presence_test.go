@@ -0,0 +1,87 @@
+package notifyi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNotifyModes(t *testing.T) {
+	checks := []struct {
+		mode     string
+		away     bool
+		offline  bool
+		notified bool
+	}{
+		{mode: "always", notified: true},
+		{mode: "offline", notified: false},
+		{mode: "offline", away: true, notified: false},
+		{mode: "away", notified: false},
+		{mode: "away", away: true, notified: true},
+		{mode: "AWAY", offline: true, notified: false},
+	}
+
+	for _, check := range checks {
+		comms := newRecordingComms()
+		bot := New("notifyi", comms)
+		bot.NamesMessage([]string{"alice", "bob"})
+		identify(bot, "alice", "SHA256:alice")
+		bot.PrivateMessage("alice", "add-watch deploy")
+		bot.PrivateMessage("alice", "notify-when "+check.mode)
+		if check.away {
+			bot.AwayMessage("alice", true)
+		}
+		if check.offline {
+			bot.UserLeftMessage("alice")
+		}
+
+		bot.PublicMessage("bob", "deploy done")
+		if got := len(comms.notifications["alice"]) == 1; got != check.notified {
+			t.Fatalf("mode %s away=%v offline=%v: notified=%v", check.mode, check.away, check.offline, got)
+		}
+	}
+}
+
+func TestOfflineModeMailsWhenGone(t *testing.T) {
+	smtpServer, mailer := startMailer(t)
+	comms := newRecordingComms()
+	bot := New("notifyi", comms, WithMailer(mailer))
+	bot.NamesMessage([]string{"alice", "bob"})
+	identify(bot, "alice", "SHA256:alice")
+	bot.PrivateMessage("alice", "register alice@example.com")
+	bot.PrivateMessage("alice", "verify alice@example.com "+pendingCode(t, bot, "SHA256:alice"))
+	bot.PrivateMessage("alice", "add-watch deploy")
+	bot.PrivateMessage("alice", "notify-when offline")
+
+	bot.PublicMessage("bob", "deploy one")
+	bot.UserLeftMessage("alice")
+	bot.PublicMessage("bob", "deploy two")
+	bot.Drain()
+
+	var mailed []string
+	for _, mail := range smtpServer.Mail() {
+		mailed = append(mailed, mail.Data)
+	}
+	if len(mailed) != 2 || !strings.Contains(mailed[1], "deploy two") {
+		t.Fatalf("expected the verification and one notification, got %q", mailed)
+	}
+}
+
+func TestLastNickIsCheckedBeforeTrusting(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	bot.NamesMessage([]string{"alice", "bob"})
+	identify(bot, "alice", "SHA256:alice")
+	bot.PrivateMessage("alice", "add-watch deploy")
+
+	// the bot reconnects and loses track of who is who
+	bot.Connected()
+	bot.NamesMessage([]string{"alice", "bob"})
+	bot.PublicMessage("bob", "deploy done")
+	if len(comms.notifications["alice"]) != 0 {
+		t.Fatal("notified a nick that was not looked up again")
+	}
+	identify(bot, "alice", "SHA256:alice")
+	if len(comms.notifications["alice"]) != 1 {
+		t.Fatalf("notification was not sent once alice was confirmed: %q", comms.notifications)
+	}
+}
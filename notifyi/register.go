@@ -0,0 +1,163 @@
+package notifyi
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	verificationCodeDigits = 6
+	verificationCodeTTL    = 15 * time.Minute
+	maxVerifyAttempts      = 5
+	registerCooldown       = time.Minute
+)
+
+var (
+	errNoPendingVerification = errors.New("there is no registration waiting for verification, register first")
+	errVerificationExpired   = errors.New("the verification code has expired, register again")
+	errTooManyAttempts       = errors.New("too many wrong codes, register again")
+	errWrongCode             = errors.New("that code is not correct")
+	errRegisterCooldown      = errors.New("a code was sent moments ago, wait a minute before asking for another")
+	errNoMailer              = errors.New("email is not configured on this bot")
+)
+
+func newVerificationCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < verificationCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate verification code: %w", err)
+	}
+	return fmt.Sprintf("%0*d", verificationCodeDigits, n), nil
+}
+
+// startRegistration mails a fresh code to email for account, nick is only
+// used to address the mail
+func (b *Bot) startRegistration(account, nick, email string) error {
+	if b.mailer == nil {
+		return errNoMailer
+	}
+
+	b.mu.Lock()
+	p, ok, err := b.store.Pending(account)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if ok && b.now().Sub(p.SentAt) < registerCooldown {
+		return errRegisterCooldown
+	}
+
+	code, err := newVerificationCode()
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Someone, hopefully %s, asked to get ssh-chat notifications at this address.\n\n"+
+		"To confirm, send this on ssh-chat:\n\n/msg %s %s %s %s\n\nThe code expires in %d minutes.",
+		nick, b.name, verifyCmdName, email, code, int(verificationCodeTTL.Minutes()))
+	if err := b.mailer.SendMail(email, "ssh-chat notification verification code", body); err != nil {
+		return err
+	}
+
+	now := b.now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.store.PutPending(account, PendingVerification{
+		Email:   email,
+		Code:    code,
+		SentAt:  now,
+		Expires: now.Add(verificationCodeTTL),
+	})
+}
+
+// completeRegistration links email to account when code matches, watches
+// a legacy nick had with the same email move over to the account
+func (b *Bot) completeRegistration(account, email, code string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p, ok, err := b.store.Pending(account)
+	if err != nil {
+		return err
+	}
+	if !ok || !strings.EqualFold(p.Email, email) {
+		return errNoPendingVerification
+	}
+	if b.now().After(p.Expires) {
+		if err := b.store.DeletePending(account); err != nil {
+			return err
+		}
+		return errVerificationExpired
+	}
+
+	p.Attempts++
+	if subtle.ConstantTimeCompare([]byte(p.Code), []byte(code)) != 1 {
+		if p.Attempts >= maxVerifyAttempts {
+			if err := b.store.DeletePending(account); err != nil {
+				return err
+			}
+			return errTooManyAttempts
+		}
+		if err := b.store.PutPending(account, p); err != nil {
+			return err
+		}
+		return errWrongCode
+	}
+
+	if err := b.store.DeletePending(account); err != nil {
+		return err
+	}
+	user, ok, err := b.store.User(account)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		user = User{Fingerprint: account, Created: b.now()}
+	}
+	user.Email = p.Email
+	if err := b.store.PutUser(user); err != nil {
+		return err
+	}
+	return b.claimLegacyWatches(account, p.Email)
+}
+
+// claimLegacyWatches adds the watches of nicks that verified email before
+// accounts were tied to keys, up to the usual limit
+func (b *Bot) claimLegacyWatches(account, email string) error {
+	legacy, err := b.store.TakeLegacyWatches(email)
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	watches, err := b.store.Watches(account)
+	if err != nil {
+		return err
+	}
+	for _, token := range legacy {
+		if len(watches) >= maxWatchesPerUser {
+			break
+		}
+		if !containsFold(watches, token) {
+			watches = append(watches, token)
+		}
+	}
+	return b.putWatches(account, watches)
+}
+
+// verifiedEmail returns the address the owner of account proved they own
+func (b *Bot) verifiedEmail(account string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	user, ok, err := b.store.User(account)
+	if err != nil || !ok || user.Email == "" {
+		return "", false
+	}
+	return user.Email, true
+}
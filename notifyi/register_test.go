@@ -0,0 +1,170 @@
+package notifyi
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/mail"
+	"github.com/voldyman/ssh-chat-notify/testutil"
+)
+
+func startMailer(t *testing.T) (*testutil.SMTPServer, Mailer) {
+	server, err := testutil.NewSMTPServer()
+	if err != nil {
+		t.Fatal("unable to start smtp server:", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	host, portStr, _ := net.SplitHostPort(server.Addr())
+	port, _ := strconv.Atoi(portStr)
+	return server, NewSMTPMailer(mail.Config{Host: host, Port: port, From: "notifyi@example.com"})
+}
+
+var codePattern = regexp.MustCompile(`verify \S+ (\d+)`)
+
+func TestRegistrationFlow(t *testing.T) {
+	smtpServer, mailer := startMailer(t)
+	comms := newRecordingComms()
+	bot := New("notifyi", comms, WithMailer(mailer))
+	identify(bot, "alice", "SHA256:alice")
+	identify(bot, "mallory", "SHA256:mallory")
+
+	bot.PrivateMessage("alice", "register alice@example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mail, err := smtpServer.WaitForMail(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal("verification mail never arrived:", err)
+	}
+	match := codePattern.FindStringSubmatch(mail.Data)
+	if match == nil {
+		t.Fatalf("no code in mail:\n%s", mail.Data)
+	}
+
+	if _, ok := bot.verifiedEmail("SHA256:alice"); ok {
+		t.Fatal("email verified before the code was entered")
+	}
+
+	bot.PrivateMessage("mallory", "verify alice@example.com "+match[1])
+	if _, ok := bot.verifiedEmail("SHA256:mallory"); ok {
+		t.Fatal("another user verified alice's code")
+	}
+
+	bot.PrivateMessage("alice", "verify alice@example.com "+match[1])
+	if email, ok := bot.verifiedEmail("SHA256:alice"); !ok || email != "alice@example.com" {
+		t.Fatalf("email not verified, replies: %q", comms.private["alice"])
+	}
+}
+
+func TestVerificationAttemptsAreLimited(t *testing.T) {
+	_, mailer := startMailer(t)
+	comms := newRecordingComms()
+	bot := New("notifyi", comms, WithMailer(mailer))
+	identify(bot, "alice", "SHA256:alice")
+
+	bot.PrivateMessage("alice", "register alice@example.com")
+	code := pendingCode(t, bot, "SHA256:alice")
+
+	for i := 0; i < maxVerifyAttempts; i++ {
+		bot.PrivateMessage("alice", "verify alice@example.com wrong")
+	}
+	bot.PrivateMessage("alice", "verify alice@example.com "+code)
+
+	if _, ok := bot.verifiedEmail("SHA256:alice"); ok {
+		t.Fatal("correct code accepted after too many wrong attempts")
+	}
+	replies := comms.private["alice"]
+	if !strings.Contains(replies[len(replies)-1], errNoPendingVerification.Error()) {
+		t.Fatalf("unexpected replies: %q", replies)
+	}
+}
+
+func TestVerificationCodeExpires(t *testing.T) {
+	_, mailer := startMailer(t)
+	bot := New("notifyi", newRecordingComms(), WithMailer(mailer))
+	now := time.Now()
+	bot.now = func() time.Time { return now }
+	identify(bot, "alice", "SHA256:alice")
+
+	bot.PrivateMessage("alice", "register alice@example.com")
+	code := pendingCode(t, bot, "SHA256:alice")
+
+	now = now.Add(verificationCodeTTL + time.Second)
+	if err := bot.completeRegistration("SHA256:alice", "alice@example.com", code); err != errVerificationExpired {
+		t.Fatal("expected expired code, got:", err)
+	}
+}
+
+func pendingCode(t *testing.T, bot *Bot, account string) string {
+	p, ok, err := bot.store.Pending(account)
+	if err != nil || !ok {
+		t.Fatalf("no pending verification for %s: %v", account, err)
+	}
+	return p.Code
+}
+
+// stalledSMTP accepts connections and never says anything
+func stalledSMTP(t *testing.T) (string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+func TestMailerTimesOut(t *testing.T) {
+	host, port := stalledSMTP(t)
+	mailer := NewSMTPMailer(mail.Config{Host: host, Port: port, From: "notifyi@example.com", Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	if err := mailer.SendMail("alice@example.com", "hi", "body"); err == nil {
+		t.Fatal("expected the stalled server to fail the mail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gave up after %s", elapsed)
+	}
+}
+
+func TestStalledMailDoesNotBlockEvents(t *testing.T) {
+	host, port := stalledSMTP(t)
+	mailer := NewSMTPMailer(mail.Config{Host: host, Port: port, From: "notifyi@example.com", Timeout: time.Second})
+	failed := make(chan error, 1)
+	store := NewMemoryStore()
+	store.PutUser(User{Fingerprint: "SHA256:alice", Name: "alice", Email: "alice@example.com"})
+	store.PutWatches("SHA256:alice", []string{"deploy"})
+	bot := New("notifyi", newRecordingComms(), WithStore(store), WithMailer(mailer),
+		WithErrorHandler(func(err error) { failed <- err }))
+
+	start := time.Now()
+	bot.PublicMessage("bob", "deploy is done")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("the room waited %s for the mail", elapsed)
+	}
+	bot.Drain()
+	select {
+	case err := <-failed:
+		if !strings.Contains(err.Error(), "alice@example.com") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	default:
+		t.Fatal("the failed mail was not reported")
+	}
+}
@@ -0,0 +1,64 @@
+package notifyi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/archive"
+)
+
+const (
+	// searchResults and searchContext keep a search reply to a handful of
+	// rate limited PMs
+	searchResults = 3
+	searchContext = 1
+)
+
+var errNoArchive = errors.New("this bot doesn't keep an archive")
+
+// search looks up terms in the public part of the archive and renders the
+// matches with the lines around them, newest match first
+func (b *Bot) search(terms string) ([]string, error) {
+	if b.archive == nil {
+		return nil, errNoArchive
+	}
+	results, err := b.archive.Search(archive.Query{
+		Terms:   []string{terms},
+		Context: searchContext,
+		Limit:   searchResults,
+		Kinds:   archive.PublicKinds,
+	})
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("%d matches for '%s', newest first", len(results), terms)
+	if len(results) == 1 {
+		header = fmt.Sprintf("1 match for '%s'", terms)
+	}
+	lines := []string{header}
+	for _, r := range results {
+		for _, e := range r.Before {
+			lines = append(lines, b.formatEntry(e, false))
+		}
+		lines = append(lines, b.formatEntry(r.Match, true))
+		for _, e := range r.After {
+			lines = append(lines, b.formatEntry(e, false))
+		}
+	}
+	return lines, nil
+}
+
+func (b *Bot) formatEntry(e archive.Entry, match bool) string {
+	layout := "15:04"
+	if b.now().Sub(e.Time) > 24*time.Hour {
+		layout = "Jan 2 15:04"
+	}
+	marker := " "
+	if match {
+		marker = ">"
+	}
+	return fmt.Sprintf("[%s] %s %s", e.Time.Format(layout), marker, strings.TrimSpace(e.String()))
+}
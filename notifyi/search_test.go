@@ -0,0 +1,50 @@
+package notifyi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/voldyman/ssh-chat-notify/archive"
+	"github.com/voldyman/ssh-chat-notify/parser"
+)
+
+func TestSearchShowsPublicContext(t *testing.T) {
+	a, err := archive.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	now := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+	for i, msg := range []parser.RoomMsg{
+		parser.PublicMsg{From: "alice", Message: "postgres or sqlite?"},
+		parser.PrivateMsg{From: "mallory", Message: "secret postgres password"},
+		parser.PublicMsg{From: "bob", Message: "postgres, decided"},
+		parser.ActionMsg{From: "alice", Message: "nods"},
+	} {
+		if err := a.Add(now.Add(time.Duration(i)*time.Minute), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	comms := newRecordingComms()
+	bot := New("notifyi", comms, WithArchive(a))
+	bot.now = func() time.Time { return now.Add(time.Hour) }
+	bot.PrivateMessage("carol", "search Postgres decided")
+
+	want := []string{
+		"1 match for 'Postgres decided'",
+		"[09:00]   alice: postgres or sqlite?",
+		"[09:02] > bob: postgres, decided",
+		"[09:03]   ** alice nods",
+	}
+	if got := comms.notifications["carol"]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected search reply:\n%q", got)
+	}
+
+	bot.PrivateMessage("carol", "search password")
+	if got := comms.private["carol"]; len(got) != 1 || got[0] != "nothing in the archive matches" {
+		t.Fatalf("private message was searchable: %q %q", got, comms.notifications["carol"])
+	}
+}
@@ -0,0 +1,269 @@
+package notifyi
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is an account, it belongs to whoever holds the ssh key with Fingerprint
+type User struct {
+	Fingerprint string
+	// Name is the nick the user last talked to the bot with
+	Name string
+	// Email is only set once the user verified it
+	Email string
+	// NotifyMode is empty for users who never chose one, which means NotifyAlways
+	NotifyMode NotifyMode
+	// LastLeft is when the user was last seen leaving the room
+	LastLeft time.Time
+	Created  time.Time
+}
+
+// PendingVerification is a code mailed to a user that hasn't been entered yet
+type PendingVerification struct {
+	Email    string
+	Code     string
+	SentAt   time.Time
+	Expires  time.Time
+	Attempts int
+}
+
+// legacyAccount is what a store written before accounts were bound to keys
+// knew about a nick, the watches can be claimed by verifying the same email
+type legacyAccount struct {
+	Email   string   `json:"email,omitempty"`
+	Watches []string `json:"watches,omitempty"`
+}
+
+// Store keeps the bot's state across restarts. Accounts are keyed by the
+// fingerprint of the user's ssh key. Every method is safe to call from
+// concurrent message handlers, returned values are copies.
+type Store interface {
+	User(account string) (User, bool, error)
+	PutUser(user User) error
+	AllUsers() ([]User, error)
+
+	Pending(account string) (PendingVerification, bool, error)
+	PutPending(account string, p PendingVerification) error
+	DeletePending(account string) error
+
+	Watches(account string) ([]string, error)
+	PutWatches(account string, watches []string) error
+	AllWatches() (map[string][]string, error)
+
+	// AppendHistory adds entry to the room history and drops the oldest
+	// entries beyond limit
+	AppendHistory(entry HistoryEntry, limit int) error
+	History() ([]HistoryEntry, error)
+
+	Notes() ([]Note, error)
+	PutNote(note Note) error
+	DeleteNote(id string) error
+
+	// TakeLegacyWatches removes and returns the watches of every legacy
+	// nick that had verified email
+	TakeLegacyWatches(email string) ([]string, error)
+
+	Close() error
+}
+
+// storeState is everything a store holds, it is what the file store writes to disk
+type storeState struct {
+	Version int                            `json:"version"`
+	Users   map[string]User                `json:"users"`
+	Pending map[string]PendingVerification `json:"pending"`
+	Watches map[string][]string            `json:"watches"`
+	Notes   map[string]Note                `json:"notes"`
+	Legacy  map[string]legacyAccount       `json:"legacy,omitempty"`
+	// History is only read from stores written before the history moved to
+	// its own file
+	History []HistoryEntry `json:"history,omitempty"`
+}
+
+func newStoreState() *storeState {
+	return &storeState{
+		Version: storeSchemaVersion,
+		Users:   map[string]User{},
+		Pending: map[string]PendingVerification{},
+		Watches: map[string][]string{},
+		Notes:   map[string]Note{},
+		Legacy:  map[string]legacyAccount{},
+	}
+}
+
+// stateStore implements Store over storeState, persist is called with the
+// lock held after every change. The room history changes with every line
+// said so it is kept apart from the state and only written to log, when
+// the store has one.
+type stateStore struct {
+	mu      sync.Mutex
+	state   *storeState
+	persist func(state *storeState) error
+	history []HistoryEntry
+	log     *historyLog
+}
+
+// NewMemoryStore creates a store that forgets everything on exit, useful for tests
+func NewMemoryStore() Store {
+	return &stateStore{
+		state:   newStoreState(),
+		persist: func(*storeState) error { return nil },
+	}
+}
+
+func (s *stateStore) User(account string) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.state.Users[account]
+	return u, ok, nil
+}
+
+func (s *stateStore) PutUser(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Users[user.Fingerprint] = user
+	return s.persist(s.state)
+}
+
+func (s *stateStore) AllUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, 0, len(s.state.Users))
+	for _, u := range s.state.Users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Fingerprint < users[j].Fingerprint })
+	return users, nil
+}
+
+func (s *stateStore) Pending(account string) (PendingVerification, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.state.Pending[account]
+	return p, ok, nil
+}
+
+func (s *stateStore) PutPending(account string, p PendingVerification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Pending[account] = p
+	return s.persist(s.state)
+}
+
+func (s *stateStore) DeletePending(account string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.state.Pending, account)
+	return s.persist(s.state)
+}
+
+func (s *stateStore) Watches(account string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.state.Watches[account]...), nil
+}
+
+func (s *stateStore) PutWatches(account string, watches []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(watches) == 0 {
+		delete(s.state.Watches, account)
+	} else {
+		s.state.Watches[account] = append([]string(nil), watches...)
+	}
+	return s.persist(s.state)
+}
+
+func (s *stateStore) AllWatches() (map[string][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make(map[string][]string, len(s.state.Watches))
+	for name, watches := range s.state.Watches {
+		all[name] = append([]string(nil), watches...)
+	}
+	return all, nil
+}
+
+func (s *stateStore) AppendHistory(entry HistoryEntry, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, entry)
+	if over := len(s.history) - limit; over > 0 {
+		s.history = append([]HistoryEntry(nil), s.history[over:]...)
+	}
+	if s.log == nil {
+		return nil
+	}
+	return s.log.append(entry, s.history)
+}
+
+func (s *stateStore) History() ([]HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HistoryEntry(nil), s.history...), nil
+}
+
+func (s *stateStore) Notes() ([]Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	notes := make([]Note, 0, len(s.state.Notes))
+	for _, n := range s.state.Notes {
+		notes = append(notes, n)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Created.Before(notes[j].Created) })
+	return notes, nil
+}
+
+func (s *stateStore) PutNote(note Note) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Notes[note.ID] = note
+	return s.persist(s.state)
+}
+
+func (s *stateStore) DeleteNote(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.state.Notes, id)
+	return s.persist(s.state)
+}
+
+func (s *stateStore) TakeLegacyWatches(email string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var nicks []string
+	for nick, legacy := range s.state.Legacy {
+		if legacy.Email != "" && strings.EqualFold(legacy.Email, email) {
+			nicks = append(nicks, nick)
+		}
+	}
+	if len(nicks) == 0 {
+		return nil, nil
+	}
+	sort.Strings(nicks)
+
+	var watches []string
+	for _, nick := range nicks {
+		watches = append(watches, s.state.Legacy[nick].Watches...)
+		delete(s.state.Legacy, nick)
+	}
+	return watches, s.persist(s.state)
+}
+
+func (s *stateStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	// leave only what the store keeps so the next start reads no more
+	// history than it needs
+	err := s.log.rewrite(s.history)
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package notifyi
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutUser(User{Fingerprint: "SHA256:alice", Name: "alice", Email: "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutWatches("SHA256:alice", []string{"deploy", "release"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, ok, err := reopened.User("SHA256:alice")
+	if err != nil || !ok || user.Email != "alice@example.com" {
+		t.Fatalf("user lost across restart: %+v %v %v", user, ok, err)
+	}
+	watches, err := reopened.Watches("SHA256:alice")
+	if err != nil || !reflect.DeepEqual(watches, []string{"deploy", "release"}) {
+		t.Fatalf("watches lost across restart: %q %v", watches, err)
+	}
+}
+
+func TestFileStoreMigratesUnversionedState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	old := `{"watches": {"bob": ["outage"], "eve": ["salary"]}, "users": {"bob": {"Name": "bob", "Email": "bob@example.com"}}}`
+	if err := ioutil.WriteFile(path, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal("unable to open old store:", err)
+	}
+	all, err := store.AllWatches()
+	if err != nil || len(all) != 0 {
+		t.Fatalf("nick keyed watches still active after migration: %q %v", all, err)
+	}
+	watches, err := store.TakeLegacyWatches("BOB@example.com")
+	if err != nil || !reflect.DeepEqual(watches, []string{"outage"}) {
+		t.Fatalf("watches lost in migration: %q %v", watches, err)
+	}
+	if watches, _ := store.TakeLegacyWatches("bob@example.com"); len(watches) != 0 {
+		t.Fatalf("legacy watches claimed twice: %q", watches)
+	}
+	if err := store.PutUser(User{Fingerprint: "SHA256:bob", Name: "bob"}); err != nil {
+		t.Fatal("migrated store is not writable:", err)
+	}
+}
+
+func TestFileStoreRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 9999}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStore(path); err == nil {
+		t.Fatal("opened a store written by a newer build")
+	}
+}
@@ -0,0 +1,257 @@
+package notifyi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	noteTTL           = 7 * 24 * time.Hour
+	maxNotesPerSender = 10
+	maxNoteLength     = 400
+)
+
+var (
+	errTooManyNotes   = fmt.Errorf("you already have %d notes waiting to be delivered", maxNotesPerSender)
+	errUnknownAccount = errors.New("nobody with that fingerprint ever talked to the bot")
+)
+
+// Note is a message left for someone who wasn't around. Notes for a known
+// account only go to the holder of that key, notes for a nick the bot has
+// never seen go to whoever shows up with it.
+type Note struct {
+	ID          string
+	From        string
+	FromAccount string
+	// ToNick is who the note is for, for account notes it is the nick the
+	// account last used and only shown to the sender
+	ToNick    string
+	ToAccount string
+	Message   string
+	Created   time.Time
+	Expires   time.Time
+}
+
+func newNoteID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("unable to generate note id: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// leaveNote stores message for to, which is a fingerprint or a nick
+func (b *Bot) leaveNote(from sender, to, message string) (Note, error) {
+	now := b.now()
+	note := Note{
+		From:        from.nick,
+		FromAccount: from.account,
+		ToNick:      to,
+		Message:     message,
+		Created:     now,
+		Expires:     now.Add(noteTTL),
+	}
+
+	account, err := b.resolveRecipient(to)
+	if err != nil {
+		return Note{}, err
+	}
+	if account != "" {
+		note.ToAccount = account
+		if nick, ok := b.currentNick(account); ok {
+			note.ToNick = nick
+		}
+	}
+
+	notes, err := b.activeNotes()
+	if err != nil {
+		return Note{}, err
+	}
+	pending := 0
+	for _, n := range notes {
+		if n.FromAccount == from.account {
+			pending++
+		}
+	}
+	if pending >= maxNotesPerSender {
+		return Note{}, errTooManyNotes
+	}
+
+	if note.ID, err = newNoteID(); err != nil {
+		return Note{}, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return note, b.store.PutNote(note)
+}
+
+// resolveRecipient finds the account a note for to belongs to, it is empty
+// for nicks no account is known by
+func (b *Bot) resolveRecipient(to string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if strings.HasPrefix(to, "SHA256:") {
+		if _, ok, err := b.store.User(to); err != nil || !ok {
+			if err == nil {
+				err = errUnknownAccount
+			}
+			return "", err
+		}
+		return to, nil
+	}
+
+	if account, ok := b.accountFor(to); ok {
+		return account, nil
+	}
+	users, err := b.store.AllUsers()
+	if err != nil {
+		return "", err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Name, to) {
+			return u.Fingerprint, nil
+		}
+	}
+	return "", nil
+}
+
+// activeNotes returns the notes that haven't expired, expired ones are
+// dropped from the store on the way
+func (b *Bot) activeNotes() ([]Note, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	notes, err := b.store.Notes()
+	if err != nil {
+		return nil, err
+	}
+	now := b.now()
+	active := notes[:0]
+	for _, n := range notes {
+		if now.After(n.Expires) {
+			if err := b.store.DeleteNote(n.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		active = append(active, n)
+	}
+	return active, nil
+}
+
+// mailNote sends a copy of an account note to its verified email
+func (b *Bot) mailNote(note Note) error {
+	if note.ToAccount == "" || b.mailer == nil {
+		return nil
+	}
+	email, ok := b.verifiedEmail(note.ToAccount)
+	if !ok {
+		return nil
+	}
+	b.mailLater(email, fmt.Sprintf("ssh-chat: a note from %s", note.From), note.Message)
+	return nil
+}
+
+// deliverNote hands note over right away when its recipient is online
+func (b *Bot) deliverNote(note Note) error {
+	if note.ToAccount != "" {
+		return b.withPresence(note.ToAccount, func(nick string, state presence) error {
+			if nick == "" {
+				return nil
+			}
+			return b.sendNote(nick, note)
+		})
+	}
+
+	b.sessionMu.Lock()
+	_, online := b.roster[note.ToNick]
+	b.sessionMu.Unlock()
+	if !online {
+		return nil
+	}
+	return b.sendNote(note.ToNick, note)
+}
+
+// deliverNotes hands over every note waiting for whoever just showed up as nick
+func (b *Bot) deliverNotes(nick string) error {
+	notes, err := b.activeNotes()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	forAccounts := false
+	for _, note := range notes {
+		if note.ToAccount != "" {
+			forAccounts = true
+			continue
+		}
+		if strings.EqualFold(note.ToNick, nick) {
+			if err := b.sendNote(nick, note); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if forAccounts {
+		err := b.withAccount(nick, func(nick, fingerprint string) error {
+			if fingerprint == "" {
+				return nil
+			}
+			notes, err := b.activeNotes()
+			if err != nil {
+				return err
+			}
+			for _, note := range notes {
+				if note.ToAccount == fingerprint {
+					if err := b.sendNote(nick, note); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to deliver notes to %s: %s", nick, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (b *Bot) sendNote(nick string, note Note) error {
+	text := fmt.Sprintf("note from %s, %s: %s", note.From, ago(b.now().Sub(note.Created)), note.Message)
+	if err := b.comms.Notification(nick, text); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.store.DeleteNote(note.ID)
+}
+
+// ago renders how long ago something happened the way people say it
+func ago(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return plural(int(d/time.Minute), "minute")
+	case d < 48*time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	}
+	return plural(int(d/(24*time.Hour)), "day")
+}
@@ -0,0 +1,97 @@
+package notifyi
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoteForNickWaitsForJoin(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	bot.NamesMessage([]string{"bob"})
+	identify(bot, "bob", "SHA256:bob")
+
+	bot.PrivateMessage("bob", "tell carol don't forget the \"keys\"")
+	if len(comms.notifications["carol"]) != 0 {
+		t.Fatal("note delivered before carol joined")
+	}
+
+	bot.UserJoinedMessage("carol")
+	got := comms.notifications["carol"]
+	if len(got) != 1 || got[0] != `note from bob, just now: don't forget the "keys"` {
+		t.Fatalf("unexpected delivery: %q", got)
+	}
+
+	bot.UserLeftMessage("carol")
+	bot.UserJoinedMessage("carol")
+	if len(comms.notifications["carol"]) != 1 {
+		t.Fatal("note delivered twice")
+	}
+}
+
+func TestNoteForAccountSkipsImpersonators(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	bot.NamesMessage([]string{"alice", "bob"})
+	identify(bot, "alice", "SHA256:alice")
+	identify(bot, "bob", "SHA256:bob")
+	bot.PrivateMessage("alice", "list-watches")
+	bot.UserLeftMessage("alice")
+
+	bot.PrivateMessage("bob", "tell alice lunch?")
+
+	bot.UserJoinedMessage("alice")
+	identify(bot, "alice", "SHA256:mallory")
+	if len(comms.notifications["alice"]) != 0 {
+		t.Fatalf("impersonator got alice's note: %q", comms.notifications["alice"])
+	}
+
+	bot.UserJoinedMessage("alice_")
+	identify(bot, "alice_", "SHA256:alice")
+	if got := comms.notifications["alice_"]; len(got) != 1 || !strings.HasSuffix(got[0], "lunch?") {
+		t.Fatalf("alice did not get her note under a new nick: %q", got)
+	}
+}
+
+func TestNotesExpireAndAreLimited(t *testing.T) {
+	comms := newRecordingComms()
+	bot := New("notifyi", comms)
+	now := time.Now()
+	bot.now = func() time.Time { return now }
+	identify(bot, "bob", "SHA256:bob")
+
+	for i := 0; i < maxNotesPerSender; i++ {
+		bot.PrivateMessage("bob", "tell carol hi")
+	}
+	bot.PrivateMessage("bob", "tell carol one more")
+	replies := comms.private["bob"]
+	if !strings.Contains(replies[len(replies)-1], errTooManyNotes.Error()) {
+		t.Fatalf("quota was not enforced: %q", replies[len(replies)-1])
+	}
+
+	now = now.Add(noteTTL + time.Minute)
+	bot.UserJoinedMessage("carol")
+	if len(comms.notifications["carol"]) != 0 {
+		t.Fatalf("expired notes were delivered: %q", comms.notifications["carol"])
+	}
+	bot.PrivateMessage("bob", "tell carol fresh start")
+	replies = comms.private["bob"]
+	if strings.Contains(replies[len(replies)-1], "unable") {
+		t.Fatalf("expired notes still count against the quota: %q", replies[len(replies)-1])
+	}
+}
+
+func TestAgo(t *testing.T) {
+	checks := map[time.Duration]string{
+		10 * time.Second: "just now",
+		time.Minute:      "1 minute ago",
+		5 * time.Hour:    "5 hours ago",
+		72 * time.Hour:   "3 days ago",
+	}
+	for d, want := range checks {
+		if got := ago(d); got != want {
+			t.Fatalf("ago(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
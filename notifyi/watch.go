@@ -0,0 +1,263 @@
+package notifyi
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/voldyman/ssh-chat-notify/match"
+)
+
+const maxWatchesPerUser = 25
+
+// nickToken is a watch that stands for the owner's current nick, it only
+// matches the nick as a whole word
+const nickToken = "$nick"
+
+var (
+	errWatchExists    = errors.New("you are already watching that")
+	errWatchNotFound  = errors.New("you are not watching that")
+	errTooManyWatches = fmt.Errorf("you can watch at most %d tokens", maxWatchesPerUser)
+	errEmptyWatch     = errors.New("can't watch an empty token")
+)
+
+func (b *Bot) addWatch(account, token string) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return errEmptyWatch
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	watches, err := b.store.Watches(account)
+	if err != nil {
+		return err
+	}
+	if containsFold(watches, token) {
+		return errWatchExists
+	}
+	if len(watches) >= maxWatchesPerUser {
+		return errTooManyWatches
+	}
+	return b.putWatches(account, append(watches, token))
+}
+
+func containsFold(watches []string, token string) bool {
+	for _, w := range watches {
+		if strings.EqualFold(w, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) stopWatch(account, token string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	watches, err := b.store.Watches(account)
+	if err != nil {
+		return err
+	}
+	for i, w := range watches {
+		if strings.EqualFold(w, token) {
+			return b.putWatches(account, append(watches[:i], watches[i+1:]...))
+		}
+	}
+	return errWatchNotFound
+}
+
+func (b *Bot) listWatches(account string) ([]string, error) {
+	return b.store.Watches(account)
+}
+
+// putWatches saves account's watches and updates the index, it must be
+// called with mu held
+func (b *Bot) putWatches(account string, watches []string) error {
+	if err := b.store.PutWatches(account, watches); err != nil {
+		return err
+	}
+	if b.watchSet == nil {
+		return nil
+	}
+	return b.indexWatches(account, watches)
+}
+
+// indexWatches puts account's tokens in the watch set, $nick changes with
+// the owner's nick so it is kept aside and checked on its own
+func (b *Bot) indexWatches(account string, watches []string) error {
+	var ids []string
+	var patterns []match.Pattern
+	delete(b.nickWatchers, account)
+	for _, token := range watches {
+		if strings.EqualFold(token, nickToken) {
+			b.nickWatchers[account] = true
+			continue
+		}
+		ids = append(ids, token)
+		patterns = append(patterns, match.Pattern{Match: token, Mode: match.ModeLiteral, IgnoreCase: true})
+	}
+	return b.watchSet.Replace(account, ids, patterns)
+}
+
+// watchIndex returns the watch set and the owners of $nick watches, the
+// set is built from the store the first time it is needed
+func (b *Bot) watchIndex() (*match.Set, []string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.watchSet == nil {
+		all, err := b.store.AllWatches()
+		if err != nil {
+			return nil, nil, err
+		}
+		b.watchSet = match.NewSet()
+		b.nickWatchers = map[string]bool{}
+		for owner, watches := range all {
+			if err := b.indexWatches(owner, watches); err != nil {
+				b.watchSet = nil
+				return nil, nil, err
+			}
+		}
+	}
+
+	nickWatchers := make([]string, 0, len(b.nickWatchers))
+	for owner := range b.nickWatchers {
+		nickWatchers = append(nickWatchers, owner)
+	}
+	return b.watchSet, nickWatchers, nil
+}
+
+// watchMatch is an account whose watch matched a room line
+type watchMatch struct {
+	owner string
+	token string
+}
+
+// matchWatches finds every owner with a watch in message, each owner
+// appears once with the first of their tokens that matched, $nick coming
+// last. Lines said by the owner, by account or by their current nick,
+// never match their own watches.
+func (b *Bot) matchWatches(fromNick, fromAccount, message string) ([]watchMatch, error) {
+	set, nickWatchers, err := b.watchIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	// the roster is read once per line rather than once per owner
+	online := b.onlineNicks()
+	nicks := map[string]string{}
+	nickOf := func(owner string) string {
+		nick, ok := nicks[owner]
+		if !ok {
+			if nick, ok = online[owner]; !ok {
+				nick, _ = b.lastNick(owner)
+			}
+			nicks[owner] = nick
+		}
+		return nick
+	}
+	said := func(owner string) bool {
+		if fromAccount != "" && owner == fromAccount {
+			return true
+		}
+		nick := nickOf(owner)
+		return nick != "" && nick == fromNick
+	}
+
+	var matches []watchMatch
+	matched := map[string]bool{}
+	for _, hit := range set.Match(message) {
+		if matched[hit.Owner] || said(hit.Owner) {
+			continue
+		}
+		matched[hit.Owner] = true
+		matches = append(matches, watchMatch{owner: hit.Owner, token: hit.Watch})
+	}
+
+	lowered := strings.ToLower(message)
+	for _, owner := range nickWatchers {
+		if matched[owner] || said(owner) {
+			continue
+		}
+		if nick := nickOf(owner); nick != "" && mentionsNick(lowered, strings.ToLower(nick)) {
+			matches = append(matches, watchMatch{owner: owner, token: nickToken})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].owner < matches[j].owner })
+	return matches, nil
+}
+
+// notifyWatchers tells the owner of every watch matching what from said
+// about the line, by email when they verified one and by PM otherwise.
+// Only message is matched so a watch never fires on the sender's nick.
+func (b *Bot) notifyWatchers(from, message, line string) error {
+	if from == b.name {
+		return nil
+	}
+
+	account, _ := b.accountFor(from)
+	matches, err := b.matchWatches(from, account, message)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, found := range matches {
+		if err := b.notify(found.owner, found.token, line); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("unable to notify watchers: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// mentionsNick reports whether nick appears in message without being part
+// of a longer nick, both are expected lowercased
+func mentionsNick(message, nick string) bool {
+	if nick == "" {
+		return false
+	}
+	for start := 0; ; {
+		i := strings.Index(message[start:], nick)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(nick)
+		if (i == 0 || !isNickByte(message[i-1])) && (end == len(message) || !isNickByte(message[end])) {
+			return true
+		}
+		start = i + 1
+	}
+}
+
+// isNickByte matches the characters that continue a nick, dots are left
+// out so a nick at the end of a sentence still counts
+func isNickByte(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// notify tells owner about a match when their notify mode wants it for
+// where they are. PMs only go to a nick their key is using, so a line never
+// reaches someone who took over the owner's old nick.
+func (b *Bot) notify(owner, token, line string) error {
+	mode := b.notifyMode(owner)
+	return b.withPresence(owner, func(nick string, state presence) error {
+		if !mode.wants(state) {
+			return nil
+		}
+		if email, ok := b.verifiedEmail(owner); ok && b.mailer != nil {
+			b.mailLater(email, fmt.Sprintf("ssh-chat: '%s' was mentioned", token), line)
+			return nil
+		}
+		if nick == "" {
+			return nil
+		}
+		return b.comms.Notification(nick, fmt.Sprintf("'%s' was mentioned: %s", token, line))
+	})
+}
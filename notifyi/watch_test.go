@@ -0,0 +1,95 @@
+package notifyi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentionsNick(t *testing.T) {
+	checks := []struct {
+		message string
+		nick    string
+		matches bool
+	}{
+		{message: "ping alice", nick: "alice", matches: true},
+		{message: "alice: lunch?", nick: "alice", matches: true},
+		{message: "thanks alice.", nick: "alice", matches: true},
+		{message: "malice aforethought", nick: "alice", matches: false},
+		{message: "alice_bot is down, alice", nick: "alice", matches: true},
+		{message: "alice_bot is down", nick: "alice", matches: false},
+		{message: "anything", nick: "", matches: false},
+	}
+	for _, check := range checks {
+		if got := mentionsNick(check.message, check.nick); got != check.matches {
+			t.Fatalf("mentionsNick(%q, %q) = %v", check.message, check.nick, got)
+		}
+	}
+}
+
+func TestMatchWatchesTracksChanges(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutWatches("SHA256:alice", []string{"deploy", "Release"})
+	store.PutWatches("SHA256:bob", []string{"release", "$nick"})
+	bot := New("notifyi", newRecordingComms(), WithStore(store))
+	bot.seen("bob", "SHA256:bob")
+
+	check := func(fromNick, fromAccount, message string, want []watchMatch) {
+		t.Helper()
+		got, err := bot.matchWatches(fromNick, fromAccount, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) && len(got)+len(want) > 0 {
+			t.Fatalf("%q: got %+v, want %+v", message, got, want)
+		}
+	}
+
+	check("carol", "", "the RELEASE is out, ask bob", []watchMatch{
+		{owner: "SHA256:alice", token: "Release"},
+		{owner: "SHA256:bob", token: "release"},
+	})
+	check("carol", "", "bob: deploy?", []watchMatch{
+		{owner: "SHA256:alice", token: "deploy"},
+		{owner: "SHA256:bob", token: nickToken},
+	})
+	check("alice", "SHA256:alice", "deploy the release", []watchMatch{
+		{owner: "SHA256:bob", token: "release"},
+	})
+
+	if err := bot.stopWatch("SHA256:alice", "deploy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.addWatch("SHA256:alice", "rollback"); err != nil {
+		t.Fatal(err)
+	}
+	check("carol", "", "deploy failed, rollback", []watchMatch{
+		{owner: "SHA256:alice", token: "rollback"},
+	})
+}
+
+func TestWatchIgnoresSenderNick(t *testing.T) {
+	store := NewMemoryStore()
+	store.PutWatches("SHA256:bob", []string{"ali"})
+	store.PutWatches("SHA256:carol", []string{"$nick"})
+	comms := newRecordingComms()
+	bot := New("notifyi", comms, WithStore(store))
+	bot.NamesMessage([]string{"alice", "bob", "carol", "dave"})
+	identify(bot, "bob", "SHA256:bob")
+	identify(bot, "carol", "SHA256:carol")
+
+	bot.PublicMessage("alice", "morning all")
+	bot.ActionMessage("alice", "waves")
+	bot.PublicMessage("carol", "morning")
+	if len(comms.notifications["bob"])+len(comms.notifications["carol"]) > 0 {
+		t.Fatalf("a nick only in the sender matched: %v", comms.notifications)
+	}
+
+	bot.PublicMessage("alice", "where is ali")
+	bot.PublicMessage("dave", "carol: ping")
+	if got := comms.notifications["bob"]; !reflect.DeepEqual(got, []string{"'ali' was mentioned: alice: where is ali"}) {
+		t.Fatalf("unexpected notifications for bob: %q", got)
+	}
+	if got := comms.notifications["carol"]; !reflect.DeepEqual(got, []string{"'$nick' was mentioned: dave: carol: ping"}) {
+		t.Fatalf("unexpected notifications for carol: %q", got)
+	}
+}
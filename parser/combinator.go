@@ -11,11 +11,14 @@ const usernameRegex = `[\w.-]*`
 func createLineParser() parsec.Parser {
 	infoParser := createInfoParser()
 	messageParser := createMessageParser()
+	awayParser := createAwayParser()
 	meMessageParser := createActionParser()
 	ackParser := createAckParser()
+	whoisParser := createWhoisParser()
+	namesParser := createNamesParser()
 	systemMessageParser := createSystemMessageParser()
 
-	return parsec.OrdChoice(selectFirstNode, infoParser, meMessageParser, messageParser, ackParser, systemMessageParser)
+	return parsec.OrdChoice(selectFirstNode, infoParser, awayParser, meMessageParser, messageParser, ackParser, whoisParser, namesParser, systemMessageParser)
 }
 
 func createInfoParser() parsec.Parser {
@@ -121,6 +124,28 @@ func createActionParser() parsec.Parser {
 	}, parsec.Atom("**", "PREFIX"), usernameParser, createMessageSuffixParser())
 }
 
+// createAwayParser matches the emotes ssh-chat sends for /away and /back,
+// it has to run before the action parser which would take them too
+func createAwayParser() parsec.Parser {
+	userNameTok := parsec.Token(usernameRegex, "USERNAME")
+	goneParser := parsec.And(func(nodes []parsec.ParsecNode) parsec.ParsecNode {
+		return AwayMsg{
+			Username: nodes[1].(*parsec.Terminal).GetValue(),
+			Away:     true,
+			Reason:   nodes[3].(string),
+		}
+	}, parsec.Atom("**", "PREFIX"), userNameTok, parsec.Atom("has gone away:", "_AWAY"), createMessageSuffixParser())
+
+	backParser := parsec.And(func(nodes []parsec.ParsecNode) parsec.ParsecNode {
+		return AwayMsg{
+			Username: nodes[1].(*parsec.Terminal).GetValue(),
+			Away:     false,
+		}
+	}, parsec.Atom("**", "PREFIX"), userNameTok, parsec.Atom("is back.", "_BACK"), parsec.End())
+
+	return parsec.OrdChoice(selectFirstNode, goneParser, backParser)
+}
+
 func createAckParser() parsec.Parser {
 	return parsec.OrdChoice(selectFirstNode, createPrivateAckMsgParser(), createPublicAckMsgParser())
 }
@@ -162,3 +187,36 @@ func createSystemMessageParser() parsec.Parser {
 		}
 	}, parsec.Atom("->", "SYSTEM_MESSAGE_PREFIX"), messageParser)
 }
+
+func createWhoisParser() parsec.Parser {
+	userNameTok := parsec.Token(usernameRegex, "USERNAME")
+	nameParser := parsec.And(func(nodes []parsec.ParsecNode) parsec.ParsecNode {
+		return WhoisMsg{
+			Field: "name",
+			Value: nodes[2].(*parsec.Terminal).GetValue(),
+		}
+	}, parsec.Atom("->", "SYSTEM_MESSAGE_PREFIX"), parsec.Atom("name:", "_WHOIS_NAME"), userNameTok, parsec.End())
+
+	fieldParser := parsec.And(func(nodes []parsec.ParsecNode) parsec.ParsecNode {
+		field := nodes[1].(*parsec.Terminal).GetValue()
+		return WhoisMsg{
+			Field: strings.TrimSuffix(field, ":"),
+			Value: nodes[2].(string),
+		}
+	}, parsec.Atom(">", "_WHOIS_FIELD_PREFIX"), parsec.Token(`[a-z]+:`, "WHOIS_FIELD"), createMessageSuffixParser())
+
+	return parsec.OrdChoice(selectFirstNode, nameParser, fieldParser)
+}
+
+func createNamesParser() parsec.Parser {
+	return parsec.And(func(nodes []parsec.ParsecNode) parsec.ParsecNode {
+		list := nodes[3].(string)
+		names := []string{}
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		return NamesMsg{Names: names}
+	}, parsec.Atom("->", "SYSTEM_MESSAGE_PREFIX"), parsec.Token(`[0-9]+`, "COUNT"), parsec.Atom("connected:", "_CONNECTED"), createMessageSuffixParser())
+}
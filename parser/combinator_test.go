@@ -23,6 +23,16 @@ func TestLines(t *testing.T) {
 		{msg: "[notifyi] /msg chirs parsing is tough", validate: validateEchoMessage("notifyi", "/msg chirs parsing is tough", AckMsgPublic)},
 		{msg: "-> [Sent PM to voldyman]", validate: validateEchoMessage("voldyman", "", AckMsgPrivate)},
 		{msg: "-> Message rejected: Rate limiting is in effect.", validate: validateSystemMessage("Message rejected: Rate limiting is in effect.")},
+		{msg: "-> name: voldyman", validate: validateWhoisMessage("name", "voldyman")},
+		{msg: " > fingerprint: SHA256:n1Ld9+TH0bTJ/mfbX3kCBzx2ZOjpCbJ4ADt+2ReyBnM", validate: validateWhoisMessage("fingerprint", "SHA256:n1Ld9+TH0bTJ/mfbX3kCBzx2ZOjpCbJ4ADt+2ReyBnM")},
+		{msg: " > fingerprint: (no public key)", validate: validateWhoisMessage("fingerprint", "(no public key)")},
+		{msg: " > joined: 5 minutes ago", validate: validateWhoisMessage("joined", "5 minutes ago")},
+		{msg: "-> name: is not a valid nick", validate: validateSystemMessage("name: is not a valid nick")},
+		{msg: "** voldyman has gone away: lunch, back at 2", validate: validateAwayMessage("voldyman", true, "lunch, back at 2")},
+		{msg: "** voldyman is back.", validate: validateAwayMessage("voldyman", false, "")},
+		{msg: "** voldyman is back. and better than ever", validate: validateMeMessage("voldyman", "is back. and better than ever")},
+		{msg: "-> 3 connected: chris, shazow, voldyman", validate: validateNamesMessage("chris", "shazow", "voldyman")},
+		{msg: "-> 0 connected: ", validate: validateNamesMessage()},
 	}
 	parser := createLineParser()
 
@@ -87,3 +97,36 @@ func validateSystemMessage(message string) validateFn {
 		return false
 	}
 }
+
+func validateWhoisMessage(field, value string) validateFn {
+	return func(parsedNode parsec.ParsecNode) bool {
+		if result, ok := parsedNode.(WhoisMsg); ok {
+			return result.Field == field && result.Value == value
+		}
+		return false
+	}
+}
+
+func validateAwayMessage(username string, away bool, reason string) validateFn {
+	return func(parsedNode parsec.ParsecNode) bool {
+		if result, ok := parsedNode.(AwayMsg); ok {
+			return result.Username == username && result.Away == away && result.Reason == reason
+		}
+		return false
+	}
+}
+
+func validateNamesMessage(names ...string) validateFn {
+	return func(parsedNode parsec.ParsecNode) bool {
+		result, ok := parsedNode.(NamesMsg)
+		if !ok || len(result.Names) != len(names) {
+			return false
+		}
+		for i := range names {
+			if result.Names[i] != names[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -1,6 +1,6 @@
 package parser
 
-// RoomMsg is one of {UsernameChangeMsg, JoinMsg, PrivateMsg, PublicMsg, ActionMsg}
+// RoomMsg is one of {UsernameChangeMsg, JoinMsg, PrivateMsg, PublicMsg, ActionMsg, AwayMsg, AckMsg, SystemMsg, WhoisMsg, NamesMsg}
 type RoomMsg interface{}
 
 // PublicMsg represents message sent to the room
@@ -21,6 +21,13 @@ type ActionMsg struct {
 	Message string
 }
 
+// AwayMsg represents a user setting or clearing their away status with '/away <reason>'
+type AwayMsg struct {
+	Username string
+	Away     bool
+	Reason   string
+}
+
 // JoinMsg represents message published by server about people joining or leaving
 type JoinMsg struct {
 	Username string
@@ -49,6 +56,18 @@ type SystemMsg struct {
 	Message string
 }
 
+// WhoisMsg represents one field of ssh-chat's reply to /whois, the reply
+// starts with the "name" field and is followed by "fingerprint", "client" and "joined"
+type WhoisMsg struct {
+	Field string
+	Value string
+}
+
+// NamesMsg represents ssh-chat's reply to /names, everyone connected to the room
+type NamesMsg struct {
+	Names []string
+}
+
 // UsernameChangeMsg represents message published by server about users changing their names
 type UsernameChangeMsg struct {
 	FromUsername string
@@ -0,0 +1,554 @@
+// Package testutil provides an in-process stand-in for ssh-chat so the
+// client and the bots can be tested without a real server
+package testutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const newline = "\r\n"
+
+// RateLimitRejection is what ssh-chat says when a user sends too fast
+const RateLimitRejection = "Message rejected: Rate limiting is in effect."
+
+// Received is a line a connected client sent to the server
+type Received struct {
+	From string
+	Line string
+}
+
+// ChatServer speaks the line formats of ssh-chat over ssh. Clients connect
+// with any key, scripted users only exist by name and are driven by the
+// test through Join, Say, Emote and the other methods. Every scripted user
+// gets a fingerprint made up from the name they joined with, it stays with
+// them across renames like a key would.
+type ChatServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+
+	mu       sync.Mutex
+	sessions map[string]*chatSession
+	// virtual maps scripted users to their fingerprint
+	virtual  map[string]string
+	received []Received
+	// closed and replaced whenever a line is received
+	changed chan struct{}
+
+	rateLimit  int
+	ratePeriod time.Duration
+
+	wg sync.WaitGroup
+}
+
+type chatSession struct {
+	name        string
+	fingerprint string
+	conn        *ssh.ServerConn
+
+	writeMu sync.Mutex
+	ch      ssh.Channel
+
+	windowStart time.Time
+	windowCount int
+}
+
+// NewChatServer starts a server on a random localhost port with a fresh
+// host key and ssh-chat's rate limit of 3 lines every 3 seconds
+func NewChatServer() (*ChatServer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate host key: %w", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create host key signer: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen: %w", err)
+	}
+
+	s := &ChatServer{
+		listener:   listener,
+		hostKey:    hostKey,
+		sessions:   map[string]*chatSession{},
+		virtual:    map[string]string{},
+		changed:    make(chan struct{}),
+		rateLimit:  3,
+		ratePeriod: 3 * time.Second,
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{
+				Extensions: map[string]string{"fingerprint": ssh.FingerprintSHA256(key)},
+			}, nil
+		},
+	}
+	s.config.AddHostKey(hostKey)
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr is the host:port clients should connect to
+func (s *ChatServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// HostKey is the server's public host key
+func (s *ChatServer) HostKey() ssh.PublicKey {
+	return s.hostKey.PublicKey()
+}
+
+// SetRateLimit changes how many lines a client may send per period, zero disables it
+func (s *ChatServer) SetRateLimit(lines int, period time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimit = lines
+	s.ratePeriod = period
+}
+
+// Close stops the server and disconnects every client
+func (s *ChatServer) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for _, sess := range s.sessions {
+		sess.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Disconnect drops the named client's connection without a goodbye, like a
+// network failure would
+func (s *ChatServer) Disconnect(name string) {
+	s.mu.Lock()
+	sess, ok := s.sessions[name]
+	s.mu.Unlock()
+	if ok {
+		sess.conn.Close()
+	}
+}
+
+// Join announces a scripted user joining the room
+func (s *ChatServer) Join(name string) {
+	s.JoinWithFingerprint(name, FakeFingerprint(name))
+}
+
+// JoinWithFingerprint announces a scripted user with the given key
+// fingerprint, "(no public key)" is what ssh-chat shows for keyless users
+func (s *ChatServer) JoinWithFingerprint(name, fingerprint string) {
+	s.mu.Lock()
+	s.virtual[name] = fingerprint
+	count := len(s.sessions) + len(s.virtual)
+	s.mu.Unlock()
+	s.Broadcast(fmt.Sprintf(" * %s joined. (Connected: %d)", name, count))
+}
+
+// Leave announces a scripted user leaving the room
+func (s *ChatServer) Leave(name string) {
+	s.mu.Lock()
+	delete(s.virtual, name)
+	s.mu.Unlock()
+	s.Broadcast(fmt.Sprintf(" * %s left. (After 60 seconds)", name))
+}
+
+// Rename announces a scripted user changing their nick
+func (s *ChatServer) Rename(from, to string) {
+	s.mu.Lock()
+	fingerprint := s.virtual[from]
+	delete(s.virtual, from)
+	s.virtual[to] = fingerprint
+	s.mu.Unlock()
+	s.Broadcast(fmt.Sprintf(" * %s is now known as %s.", from, to))
+}
+
+// Away marks a scripted user away the way ssh-chat's /away announces it
+func (s *ChatServer) Away(name, reason string) {
+	s.Emote(name, "has gone away: "+reason)
+}
+
+// Back clears a scripted user's away status
+func (s *ChatServer) Back(name string) {
+	s.Emote(name, "is back.")
+}
+
+// Say sends a room message from a scripted user
+func (s *ChatServer) Say(from, message string) {
+	s.Broadcast(fmt.Sprintf("%s: %s", from, message))
+}
+
+// Emote sends a /me action from a scripted user
+func (s *ChatServer) Emote(from, action string) {
+	s.Broadcast(fmt.Sprintf("** %s %s", from, action))
+}
+
+// PrivateMessage sends a PM from a scripted user to a connected client
+func (s *ChatServer) PrivateMessage(from, to, message string) error {
+	sess, ok := s.session(to)
+	if !ok {
+		return fmt.Errorf("%s is not connected", to)
+	}
+	sess.writeLine(fmt.Sprintf("[PM from %s] %s", from, message))
+	return nil
+}
+
+// System sends a system message to a connected client
+func (s *ChatServer) System(to, message string) error {
+	sess, ok := s.session(to)
+	if !ok {
+		return fmt.Errorf("%s is not connected", to)
+	}
+	sess.writeLine("-> " + message)
+	return nil
+}
+
+// Broadcast writes a raw line to every connected client
+func (s *ChatServer) Broadcast(line string) {
+	for _, sess := range s.connected() {
+		sess.writeLine(line)
+	}
+}
+
+// Received returns every line clients have sent so far
+func (s *ChatServer) Received() []Received {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Received(nil), s.received...)
+}
+
+// WaitFor blocks until a client sent a line matching the check and returns
+// it, lines received before the call are checked too
+func (s *ChatServer) WaitFor(ctx context.Context, matches func(r Received) bool) (Received, error) {
+	seen := 0
+	for {
+		s.mu.Lock()
+		pending := s.received[seen:]
+		seen = len(s.received)
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, r := range pending {
+			if matches(r) {
+				return r, nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Received{}, ctx.Err()
+		}
+	}
+}
+
+// WaitForConnection blocks until a client with the given name is connected
+func (s *ChatServer) WaitForConnection(ctx context.Context, name string) error {
+	for {
+		if _, ok := s.session(name); ok {
+			return nil
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *ChatServer) session(name string) (*chatSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[name]
+	return sess, ok
+}
+
+func (s *ChatServer) names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.sessions)+len(s.virtual))
+	for name := range s.sessions {
+		names = append(names, name)
+	}
+	for name := range s.virtual {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *ChatServer) fingerprint(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[name]; ok {
+		if sess.fingerprint == "" {
+			return "(no public key)", true
+		}
+		return sess.fingerprint, true
+	}
+	fingerprint, ok := s.virtual[name]
+	return fingerprint, ok
+}
+
+func (s *ChatServer) connected() []*chatSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*chatSession, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func (s *ChatServer) record(from, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, Received{From: from, Line: line})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *ChatServer) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+func (s *ChatServer) serve(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	defer conn.Close()
+	// replies false to keepalives, which is what ssh-chat does
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+		go acceptTerminalRequests(chReqs)
+
+		sess := &chatSession{
+			name:        s.uniqueName(conn.User()),
+			fingerprint: conn.Permissions.Extensions["fingerprint"],
+			conn:        conn,
+			ch:          ch,
+		}
+		s.serveSession(sess)
+		return
+	}
+}
+
+func acceptTerminalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req", "shell", "window-change":
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// uniqueName picks a free name the same way ssh-chat renames clashing users
+func (s *ChatServer) uniqueName(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidate := name
+	for i := 1; ; i++ {
+		_, connected := s.sessions[candidate]
+		if _, virtual := s.virtual[candidate]; !connected && !virtual {
+			return candidate
+		}
+		candidate = fmt.Sprintf("Guest%d", i)
+	}
+}
+
+func (s *ChatServer) serveSession(sess *chatSession) {
+	s.mu.Lock()
+	s.sessions[sess.name] = sess
+	count := len(s.sessions) + len(s.virtual)
+	s.mu.Unlock()
+	s.Broadcast(fmt.Sprintf(" * %s joined. (Connected: %d)", sess.name, count))
+
+	scanner := bufio.NewScanner(sess.ch)
+	scanner.Split(scanTerminalLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		s.record(sess.name, line)
+		s.handleLine(sess, line)
+	}
+
+	s.mu.Lock()
+	delete(s.sessions, sess.name)
+	s.mu.Unlock()
+	sess.ch.Close()
+	s.Broadcast(fmt.Sprintf(" * %s left. (After 1 second)", sess.name))
+}
+
+func (s *ChatServer) allow(sess *chatSession) bool {
+	s.mu.Lock()
+	limit, period := s.rateLimit, s.ratePeriod
+	s.mu.Unlock()
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	if now.After(sess.windowStart.Add(period)) {
+		sess.windowStart = now
+		sess.windowCount = 0
+	}
+	sess.windowCount++
+	return sess.windowCount <= limit
+}
+
+func (s *ChatServer) handleLine(sess *chatSession, line string) {
+	if !s.allow(sess) {
+		sess.writeLine("-> " + RateLimitRejection)
+		return
+	}
+
+	if !strings.HasPrefix(line, "/") {
+		sess.writeLine(fmt.Sprintf("[%s] %s", sess.name, line))
+		for _, other := range s.connected() {
+			if other != sess {
+				other.writeLine(fmt.Sprintf("%s: %s", sess.name, line))
+			}
+		}
+		return
+	}
+
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/msg":
+		if len(fields) < 3 {
+			sess.writeLine("-> Err: must specify user and message")
+			return
+		}
+		to := fields[1]
+		rest := strings.TrimSpace(strings.TrimPrefix(line, "/msg"))
+		message := strings.TrimSpace(strings.TrimPrefix(rest, to))
+		s.mu.Lock()
+		target, connected := s.sessions[to]
+		_, virtual := s.virtual[to]
+		known := connected || virtual
+		s.mu.Unlock()
+		if !known {
+			sess.writeLine("-> Err: user not found")
+			return
+		}
+		if connected {
+			target.writeLine(fmt.Sprintf("[PM from %s] %s", sess.name, message))
+		}
+		sess.writeLine(fmt.Sprintf("-> [Sent PM to %s]", to))
+
+	case "/me":
+		s.Broadcast(fmt.Sprintf("** %s %s", sess.name, strings.TrimSpace(strings.TrimPrefix(line, "/me"))))
+
+	case "/nick":
+		if len(fields) != 2 {
+			sess.writeLine("-> Err: must specify new name")
+			return
+		}
+		s.mu.Lock()
+		old := sess.name
+		delete(s.sessions, old)
+		sess.name = fields[1]
+		s.sessions[sess.name] = sess
+		s.mu.Unlock()
+		s.Broadcast(fmt.Sprintf(" * %s is now known as %s.", old, sess.name))
+
+	case "/names":
+		names := s.names()
+		sess.writeLine(fmt.Sprintf("-> %d connected: %s", len(names), strings.Join(names, ", ")))
+
+	case "/whois":
+		if len(fields) != 2 {
+			sess.writeLine("-> Err: must specify user")
+			return
+		}
+		fingerprint, ok := s.fingerprint(fields[1])
+		if !ok {
+			sess.writeLine("-> Err: user not found")
+			return
+		}
+		sess.writeLine("-> name: " + fields[1])
+		sess.writeLine(" > fingerprint: " + fingerprint)
+		sess.writeLine(" > client: SSH-2.0-Go")
+		sess.writeLine(" > joined: 1 minute ago")
+
+	default:
+		sess.writeLine("-> Err: invalid command: " + fields[0])
+	}
+}
+
+// FakeFingerprint is the fingerprint Join gives a scripted user
+func FakeFingerprint(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func (sess *chatSession) writeLine(line string) {
+	sess.writeMu.Lock()
+	defer sess.writeMu.Unlock()
+	io.WriteString(sess.ch, line+newline)
+}
+
+// scanTerminalLines splits on \r, \n or \r\n, terminals send any of them
+func scanTerminalLines(data []byte, atEOF bool) (int, []byte, error) {
+	for i, b := range data {
+		if b != '\r' && b != '\n' {
+			continue
+		}
+		advance := i + 1
+		if b == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			advance++
+		} else if b == '\r' && i+1 == len(data) && !atEOF {
+			// the \n may still be on its way
+			return 0, nil, nil
+		}
+		return advance, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,181 @@
+package testutil
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Mail is a message accepted by the SMTP stand-in
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTPServer accepts mail on a random localhost port and keeps it in memory.
+// It speaks just enough SMTP for net/smtp without TLS or authentication.
+type SMTPServer struct {
+	listener net.Listener
+
+	mu   sync.Mutex
+	mail []Mail
+	// closed and replaced whenever mail arrives
+	changed chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewSMTPServer starts the stand-in
+func NewSMTPServer() (*SMTPServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen: %w", err)
+	}
+	s := &SMTPServer{listener: listener, changed: make(chan struct{})}
+	s.wg.Add(1)
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Addr is the host:port to send mail to
+func (s *SMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting mail
+func (s *SMTPServer) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Mail returns everything received so far
+func (s *SMTPServer) Mail() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail(nil), s.mail...)
+}
+
+// WaitForMail blocks until a mail to the given address arrives
+func (s *SMTPServer) WaitForMail(ctx context.Context, to string) (Mail, error) {
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		for _, m := range s.mail {
+			for _, rcpt := range m.To {
+				if strings.EqualFold(rcpt, to) {
+					s.mu.Unlock()
+					return m, nil
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Mail{}, ctx.Err()
+		}
+	}
+}
+
+func (s *SMTPServer) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.serve(textproto.NewConn(conn))
+		}()
+	}
+}
+
+func (s *SMTPServer) serve(conn *textproto.Conn) {
+	conn.PrintfLine("220 localhost test SMTP ready")
+
+	var current Mail
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+
+		switch verb {
+		case "EHLO", "HELO":
+			conn.PrintfLine("250 localhost")
+		case "MAIL":
+			current = Mail{From: smtpAddress(arg)}
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			current.To = append(current.To, smtpAddress(arg))
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := readData(conn.Reader.R)
+			if err != nil {
+				return
+			}
+			current.Data = data
+			s.deliver(current)
+			current = Mail{}
+			conn.PrintfLine("250 OK")
+		case "RSET":
+			current = Mail{}
+			conn.PrintfLine("250 OK")
+		case "NOOP":
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 bye")
+			return
+		default:
+			conn.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+func (s *SMTPServer) deliver(m Mail) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mail = append(s.mail, m)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// smtpAddress pulls the address out of "FROM:<a@b>" or "TO:<a@b>"
+func smtpAddress(arg string) string {
+	start := strings.Index(arg, "<")
+	end := strings.LastIndex(arg, ">")
+	if start == -1 || end < start {
+		return arg
+	}
+	return arg[start+1 : end]
+}
+
+func readData(r *bufio.Reader) (string, error) {
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "." {
+			return data.String(), nil
+		}
+		// undo dot stuffing
+		data.WriteString(strings.TrimPrefix(trimmed, "."))
+		data.WriteString("\n")
+	}
+}